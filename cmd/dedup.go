@@ -0,0 +1,210 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/replay"
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// dedupCmd represents the dedup command
+var dedupCmd = &cobra.Command{
+	Use:   "dedup",
+	Short: "Remove duplicate packets and report where they come from.",
+	Long: `Read pcap files in global timestamp order and write each packet only once. Packets are
+remembered for a window of packet time, so results do not depend on read speed. Duplicates are
+also found across files, for example when two SPAN ports mirror same traffic.
+
+Duplicate ratio is reported per input file and per source MAC and VLAN, to spot which mirror
+port is doubling traffic. Dropped packets can be written to a separate file for inspection.
+
+Input is a single file, a folder, or mapped pcap set when --input is not given.
+
+Example usage:
+gopherCap dedup \
+	--input /mnt/pcap \
+	--out-file /mnt/dedup/dedup.pcap \
+	--duplicates-file /mnt/dedup/duplicates.pcap \
+	--report /mnt/dedup/report.json
+
+Deduplicate a mapped set, rotating output every 100 megabytes:
+gopherCap dedup \
+	--dump-json /mnt/pcap/meta.json \
+	--out-file "/mnt/dedup/dedup.%t.pcap" \
+	--rotate-mb 100
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var files []*replay.Pcap
+		if input := viper.GetString("dedup.input"); input != "" {
+			stat, err := os.Stat(input)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			paths := []string{input}
+			if stat.IsDir() {
+				paths, err = replay.FindPcapFiles(input, viper.GetString("dedup.suffix"))
+				if err != nil {
+					logrus.Fatalf("PCAP list gen: %s", err)
+				}
+			}
+			if files, err = replay.PeekPcaps(paths); err != nil {
+				logrus.Fatal(err)
+			}
+		} else {
+			set, err := replay.LoadSetJSON(viper.GetString("global.dump.json"))
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			if err := set.Subset(fileRegexpArg(), time.Time{}, time.Time{}); err != nil {
+				logrus.Fatal(err)
+			}
+			files = set.Files
+		}
+		out := viper.GetString("dedup.out.file")
+		if out == "" {
+			logrus.Fatal("Missing output file")
+		}
+		rotateBytes := viper.GetInt64("dedup.rotate.mb") * 1024 * 1024
+		outputConfig := func(path string) rotate.Config {
+			if path == "" {
+				return rotate.Config{}
+			}
+			createDir(filepath.Dir(path))
+			return rotate.Config{
+				Dir:      filepath.Dir(path),
+				Template: filepath.Base(path),
+				Compress: viper.GetBool("dedup.out.gzip"),
+				MaxBytes: rotateBytes,
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		chSIG := make(chan os.Signal, 1)
+		signal.Notify(chSIG, os.Interrupt)
+		go func() {
+			<-chSIG
+			cancel()
+		}()
+
+		start := time.Now()
+		res, err := replay.Dedup(replay.DedupConfig{
+			Files:      files,
+			Output:     outputConfig(out),
+			Duplicates: outputConfig(viper.GetString("dedup.duplicates.file")),
+			Dedup:      dedupConfigArg("dedup."),
+			Inner:      viper.GetBool("dedup.inner"),
+			Ctx:        ctx,
+		})
+		if res == nil {
+			logrus.Fatal(err)
+		}
+		logDedupStats("file", res.Files)
+		logDedupStats("source", res.Sources)
+		for _, f := range append(res.OutputFiles, res.DuplicateFiles...) {
+			logrus.WithFields(logrus.Fields{
+				"path":    f.Path,
+				"packets": f.Packets,
+				"bytes":   f.Bytes,
+			}).Info("file written")
+		}
+		if report := viper.GetString("dedup.report"); report != "" {
+			data, jerr := json.MarshalIndent(res, "", "  ")
+			if jerr != nil {
+				logrus.Fatal(jerr)
+			}
+			if jerr := os.WriteFile(report, data, 0640); jerr != nil {
+				logrus.Fatal(jerr)
+			}
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"packets":    res.Packets,
+			"duplicates": res.Duplicates,
+			"ratio":      res.Ratio,
+		}).Infof("Dedup done in %s.", time.Since(start))
+	},
+}
+
+// logDedupStats logs duplicate counts sorted by ratio, so worst offenders come first
+func logDedupStats(kind string, stats map[string]*replay.DedupStats) {
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if stats[keys[i]].Ratio != stats[keys[j]].Ratio {
+			return stats[keys[i]].Ratio > stats[keys[j]].Ratio
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		logrus.WithFields(logrus.Fields{
+			kind:         key,
+			"packets":    stats[key].Packets,
+			"duplicates": stats[key].Duplicates,
+			"ratio":      stats[key].Ratio,
+		}).Info("duplicates")
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(dedupCmd)
+
+	dedupCmd.PersistentFlags().String("input", "",
+		`Input pcap file or folder. Mapped set from dump-json is used if not given.`)
+	viper.BindPFlag("dedup.input", dedupCmd.PersistentFlags().Lookup("input"))
+
+	dedupCmd.PersistentFlags().String("suffix", "pcap",
+		`Find files with following suffix if input is a folder.`)
+	viper.BindPFlag("dedup.suffix", dedupCmd.PersistentFlags().Lookup("suffix"))
+
+	dedupCmd.PersistentFlags().String("out-file", "",
+		`Output pcap file for unique packets. Must contain %t if rotation is enabled.`)
+	viper.BindPFlag("dedup.out.file", dedupCmd.PersistentFlags().Lookup("out-file"))
+
+	dedupCmd.PersistentFlags().String("duplicates-file", "",
+		`Optional output pcap file for dropped duplicates. Must contain %t if rotation is enabled.`)
+	viper.BindPFlag("dedup.duplicates.file", dedupCmd.PersistentFlags().Lookup("duplicates-file"))
+
+	dedupCmd.PersistentFlags().Bool("out-gzip", false,
+		`Compress output with gzip.`)
+	viper.BindPFlag("dedup.out.gzip", dedupCmd.PersistentFlags().Lookup("out-gzip"))
+
+	dedupCmd.PersistentFlags().Int64("rotate-mb", 0,
+		`Rotate output file once it reaches this size in megabytes. 0 disables.`)
+	viper.BindPFlag("dedup.rotate.mb", dedupCmd.PersistentFlags().Lookup("rotate-mb"))
+
+	dedupCmd.PersistentFlags().String("report", "",
+		`Optional JSON file for duplicate statistics per file and source.`)
+	viper.BindPFlag("dedup.report", dedupCmd.PersistentFlags().Lookup("report"))
+
+	dedupFlags(dedupCmd, "", "dedup.")
+}
@@ -19,14 +19,17 @@ package cmd
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"time"
+	"sort"
+	"sync"
 
 	"github.com/StamusNetworks/gophercap/pkg/dedup"
 	"github.com/StamusNetworks/gophercap/pkg/filter"
 	"github.com/StamusNetworks/gophercap/pkg/replay"
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/sirupsen/logrus"
@@ -57,7 +60,58 @@ var filterCmd = &cobra.Command{
 			logrus.Fatal(errors.New("Missing output folder"))
 		}
 
+		flowMode, err := filter.NewFlowMode(viper.GetString("filter.flow.mode"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		outputMode, err := filter.NewOutputMode(viper.GetString("filter.mode.output"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		rotateBytes := viper.GetInt64("filter.rotate.mb") * 1024 * 1024
+		if rotateBytes < 0 {
+			logrus.Fatalf("Invalid rotation size: %d", rotateBytes)
+		}
+		if rotateBytes > 0 && outputMode == filter.OutputModeFlow {
+			logrus.Warn("Size rotation is not supported for per-flow output, ignoring")
+		}
+		if workers > 1 && outputMode == filter.OutputModeFlow {
+			// flows spanning many inputs would be written out of time order
+			logrus.Fatal("Per-flow output needs inputs to be read one at a time, use --workers 1")
+		}
+
+		pcapng := viper.GetBool("filter.pcapng")
+		splitTunnel := viper.GetBool("filter.split.tunnel")
+		if (pcapng || splitTunnel) && outputMode != filter.OutputModeInput {
+			logrus.Fatal("Pcapng output and tunnel split are only supported with input output mode")
+		}
+		if splitTunnel && !viper.GetBool("filter.decap.enabled") {
+			logrus.Fatal("Tunnel split needs decapsulation to be enabled")
+		}
+
+		resume := viper.GetBool("filter.resume")
+		if resume && outputMode == filter.OutputModeFlow {
+			// flow files are appended to by many inputs, partial writes can not be redone
+			logrus.Fatal("Resume is not supported with per-flow output")
+		}
+
+		dedupEnabled := dedupEnabledArg()
+		dedupConfig := dedupConfigArg("filter.dedup.")
+		if dedupEnabled {
+			if err := dedupConfig.Validate(); err != nil {
+				logrus.Fatal(err)
+			}
+			logrus.WithFields(logrus.Fields{
+				"window":    dedupConfig.Window,
+				"buckets":   dedupConfig.Buckets,
+				"memory_mb": dedupConfig.MemoryBytes() / 1024 / 1024,
+			}).Info("Dedup enabled, memory is per worker")
+		}
+
 		filters := make(map[string]filter.Matcher)
+		// per condition hit counts, only available for filters from YAML config
+		hits := make(map[string]*filter.ConditionHits)
 
 		if configPath := viper.GetString("filter.yaml"); configPath != "" {
 			var cfg filter.YAMLConfig
@@ -69,9 +123,14 @@ var filterCmd = &cobra.Command{
 				logrus.Fatal(err)
 			}
 			for name, config := range cfg {
+				hits[name] = &filter.ConditionHits{}
 				m, err := filter.NewCombinedMatcher(filter.MatcherConfig{
 					CombinedConfig: config,
 					MaxMindASN:     viper.GetString("filter.maxmind.asn"),
+					MaxMindCountry: viper.GetString("filter.maxmind.country"),
+					MaxMindCity:    viper.GetString("filter.maxmind.city"),
+					FlowTimeout:    viper.GetDuration("filter.flow.timeout"),
+					Hits:           hits[name],
 				})
 				if err != nil {
 					logrus.Fatal(err)
@@ -84,10 +143,32 @@ var filterCmd = &cobra.Command{
 			filters["raw"] = filter.DummyMatcher{}
 		}
 
+		createDir(output)
+		checkpointPath := viper.GetString("filter.checkpoint")
+		if checkpointPath == "" {
+			checkpointPath = filepath.Join(output, filter.CheckpointFile)
+		}
+		checkpoint, err := filter.OpenCheckpoint(checkpointPath, resume)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if resume {
+			logrus.Infof("Resuming with %d completed tasks from %s", checkpoint.Len(), checkpointPath)
+		}
+
 		tasks := make(chan filter.Task, workers)
 
-		ctx, cancel := context.WithCancel(context.Background())
-		pool, ctx := errgroup.WithContext(ctx)
+		// manifest entries, summaries per filter and failed task count, collected from all workers
+		var manifestLock sync.Mutex
+		var failed int
+		manifests := make(map[string][]filter.ManifestEntry)
+		summaries := make(map[string]*filter.Summary)
+		for name := range filters {
+			summaries[name] = &filter.Summary{Filter: name}
+		}
+
+		stopCtx, cancel := context.WithCancel(context.Background())
+		pool, ctx := errgroup.WithContext(stopCtx)
 		for i := 0; i < workers; i++ {
 			id := i
 			pool.Go(func() error {
@@ -104,9 +185,8 @@ var filterCmd = &cobra.Command{
 							break loop
 						}
 						logrus.WithFields(logrus.Fields{
-							"input":  task.Input,
-							"output": filepath.Dir(task.Output),
-							"desc":   task.Description,
+							"input": task.Input,
+							"desc":  task.Description,
 						}).Info("Filtering file")
 						result, err := filter.ReadAndFilter(&filter.Config{
 							File: struct {
@@ -117,19 +197,38 @@ var filterCmd = &cobra.Command{
 								Output: task.Output,
 							},
 							Filter:        task.Filter,
+							Targets:       task.Targets,
 							Decapsulate:   viper.GetBool("filter.decap.enabled"),
 							DecapMaxDepth: viper.GetInt("filter.decap.depth"),
-							Compress:      viper.GetBool("filter.compress"),
+							StripVLAN:     viper.GetBool("filter.strip.vlan"),
+							StripMPLS:     viper.GetBool("filter.strip.mpls"),
+							FlowMode:      flowMode,
+							FlowTimeout:   viper.GetDuration("filter.flow.timeout"),
+							// merged mode parts are temporary, so only final output is compressed
+							Compress:    viper.GetBool("filter.compress") && outputMode != filter.OutputModeMerged,
+							Pcapng:      pcapng,
+							SplitTunnel: splitTunnel,
+							RotateBytes: func() int64 {
+								if outputMode == filter.OutputModeInput {
+									return rotateBytes
+								}
+								return 0
+							}(),
 							StatFunc: func(fr map[string]any) {
 								logrus.WithField("worker", id).WithFields(fr).Debug("filter report")
 							},
 							Ctx: ctx,
 							Dedup: func() dedup.Dedupper {
-								if viper.GetBool("filter.dedup") {
-									return dedup.NewCircularDedup(3, 2*time.Second)
+								if !dedupEnabled {
+									return nil
+								}
+								d, err := dedup.NewWindowDedup(dedupConfig)
+								if err != nil {
+									logrus.Fatal(err)
 								}
-								return nil
+								return d
 							}(),
+							DedupInner: viper.GetBool("filter.dedup.inner"),
 						})
 						if err != nil {
 							switch err.(type) {
@@ -137,10 +236,34 @@ var filterCmd = &cobra.Command{
 								logrus.WithField("worker", id).Warn("early exit called")
 								break loop
 							default:
-								logrus.Error(err)
+								logrus.WithField("input", task.Input).Error(err)
+								// failed tasks are not recorded in checkpoint, so resume redoes them
+								removeOutputs(result)
+								manifestLock.Lock()
+								failed++
+								for _, t := range task.Targets {
+									summaries[t.Name].AddFailed(task.Input)
+								}
+								manifestLock.Unlock()
+								continue loop
 							}
 						}
 						logrus.Infof("DONE: %+v", result)
+						for name, tr := range result.Targets {
+							entries := filter.NewManifestEntries([]string{task.Input}, tr.Files)
+							manifestLock.Lock()
+							manifests[name] = append(manifests[name], entries...)
+							summaries[name].AddResult(result, tr)
+							manifestLock.Unlock()
+							if err := checkpoint.Add(filter.CheckpointRecord{
+								Input:   task.Input,
+								Filter:  name,
+								Matched: tr.Matched,
+								Outputs: entries,
+							}); err != nil {
+								logrus.Error(err)
+							}
+						}
 					}
 				}
 				return nil
@@ -160,38 +283,108 @@ var filterCmd = &cobra.Command{
 			logrus.Fatalf("PCAP list gen: %s", err)
 		}
 
+		names := make([]string, 0, len(filters))
+		for name := range filters {
+			createDir(filepath.Join(output, name))
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// merged mode filters each input into a temporary part, parts are merged once all are done
+		var partsDir string
+		if outputMode == filter.OutputModeMerged {
+			// parts of completed tasks are needed when resuming, so location is fixed
+			partsDir = filepath.Join(output, ".parts")
+			if !resume {
+				if err := os.RemoveAll(partsDir); err != nil {
+					logrus.Fatal(err)
+				}
+			}
+			createDir(partsDir)
+			for _, name := range names {
+				createDir(filepath.Join(partsDir, name))
+			}
+		}
+		flowWriters := make(map[string]*filter.FlowWriter)
+		if outputMode == filter.OutputModeFlow {
+			for _, name := range names {
+				flowWriters[name] = filter.NewFlowWriter(
+					filepath.Join(output, name),
+					viper.GetBool("filter.compress"),
+					viper.GetInt("filter.flow.max.open"),
+				)
+			}
+		}
+		target := func(name, outFile string) filter.Target {
+			t := filter.Target{Name: name, Filter: filters[name]}
+			switch outputMode {
+			case filter.OutputModeMerged:
+				t.Output = filepath.Join(partsDir, name, outFile)
+			case filter.OutputModeFlow:
+				t.Writer = flowWriters[name]
+			default:
+				t.Output = filepath.Join(output, name, outFile)
+			}
+			return t
+		}
+
 	outer:
 		for _, inFile := range files {
-		inner:
-			for name, matcher := range filters {
-				outDir := filepath.Join(output, name)
-				stat, err := os.Stat(outDir)
-				if os.IsNotExist(err) {
-					if err := os.Mkdir(outDir, 0750); err != nil {
-						logrus.Fatal(err)
-					}
-				} else if !stat.IsDir() {
-					logrus.Fatalf("Output path %s exists and is not a directory", output)
+			outFile := filter.ExtractBaseName(inFile) + ".pcap"
+			if pcapng {
+				outFile += "ng"
+			}
+
+			pending := make([]string, 0, len(names))
+			for _, name := range names {
+				if rec, ok := checkpoint.Done(inFile, name); ok {
+					manifestLock.Lock()
+					manifests[name] = append(manifests[name], rec.Outputs...)
+					summaries[name].AddResumed(rec)
+					manifestLock.Unlock()
+					logrus.WithFields(logrus.Fields{
+						"input":  inFile,
+						"filter": name,
+					}).Debug("skipping completed task")
+					continue
 				}
+				pending = append(pending, name)
+			}
+			if len(pending) == 0 {
+				continue outer
+			}
 
-				outFile := filter.ExtractBaseName(inFile) + ".pcap"
-				outFile = filepath.Join(outDir, outFile)
+			batch := make([]filter.Task, 0, len(pending))
+			if viper.GetBool("filter.single.pass") {
+				targets := make([]filter.Target, 0, len(pending))
+				for _, name := range pending {
+					targets = append(targets, target(name, outFile))
+				}
+				batch = append(batch, filter.Task{
+					Input:       inFile,
+					Targets:     targets,
+					Description: fmt.Sprintf("%d filters", len(targets)),
+				})
+			} else {
+				for _, name := range pending {
+					batch = append(batch, filter.Task{
+						Input:       inFile,
+						Targets:     []filter.Target{target(name, outFile)},
+						Description: name,
+					})
+				}
+			}
 
+			for _, task := range batch {
 				logrus.WithFields(logrus.Fields{
-					"filter": name,
-					"path":   outFile,
+					"input": task.Input,
+					"desc":  task.Description,
 				}).Info("feeding file to matcher")
 
 				select {
-				case tasks <- filter.Task{
-					Input:       inFile,
-					Output:      outFile,
-					Filter:      matcher,
-					Description: name,
-				}:
+				case tasks <- task:
 				case <-ctx.Done():
 					break outer
-					break inner
 				}
 			}
 		}
@@ -199,9 +392,218 @@ var filterCmd = &cobra.Command{
 		if err := pool.Wait(); err != nil {
 			logrus.Fatal(err)
 		}
+
+		for _, name := range names {
+			if fw, ok := flowWriters[name]; ok {
+				if err := fw.Close(); err != nil {
+					logrus.Error(err)
+				}
+				logrus.WithField("filter", name).Infof("wrote %d flow files", fw.Files())
+				entries, err := fw.Manifest()
+				if err != nil {
+					logrus.Error(err)
+				}
+				manifests[name] = entries
+			}
+		}
+
+		if stopCtx.Err() != nil {
+			checkpoint.Close()
+			logrus.Warnf("Interrupted, %d tasks completed. Rerun with --resume to continue", checkpoint.Len())
+			return
+		}
+
+		// parts of completed tasks are needed when resuming failed ones, so they are not merged
+		merge := partsDir != "" && failed == 0
+		if merge {
+			for _, name := range names {
+				written := mergeParts(filepath.Join(partsDir, name), filepath.Join(output, name), name, rotateBytes)
+				// merged files hold packets from all inputs that had a match
+				sources := make([]string, 0, len(manifests[name]))
+				for _, part := range manifests[name] {
+					sources = append(sources, part.Sources...)
+				}
+				sort.Strings(sources)
+				manifests[name] = filter.NewManifestEntries(sources, written)
+			}
+			if err := os.RemoveAll(partsDir); err != nil {
+				logrus.Error(err)
+			}
+		}
+
+		for _, name := range names {
+			summary := summaries[name]
+			if partsDir == "" || merge {
+				entries := manifests[name]
+				if entries == nil {
+					entries = []filter.ManifestEntry{}
+				}
+				if err := filter.WriteManifest(filepath.Join(output, name), entries); err != nil {
+					logrus.Error(err)
+				}
+				summary.AddOutputs(entries)
+			}
+			summary.AddHits(hits[name])
+			if err := filter.WriteSummary(filepath.Join(output, name), *summary); err != nil {
+				logrus.Error(err)
+			}
+			logrus.WithFields(logrus.Fields{
+				"filter":       name,
+				"inputs":       summary.Inputs,
+				"matched":      summary.Matched,
+				"errors":       summary.Errors,
+				"decap_errors": summary.DecapErrors,
+				"dedup_ratio":  summary.DedupRatio,
+				"output_bytes": summary.OutputBytes,
+			}).Info("filter summary")
+			if summary.ASNLookupErrs > 0 || summary.ASNIPParseErrs > 0 {
+				logrus.WithFields(logrus.Fields{
+					"filter":        name,
+					"lookup_errs":   summary.ASNLookupErrs,
+					"ip_parse_errs": summary.ASNIPParseErrs,
+				}).Warn("ASN lookups failed")
+			}
+			if summary.GeoLookupErrs > 0 {
+				logrus.WithFields(logrus.Fields{
+					"filter":      name,
+					"lookup_errs": summary.GeoLookupErrs,
+				}).Warn("GeoIP lookups failed")
+			}
+		}
+		if failed > 0 {
+			checkpoint.Close()
+			if outputMode == filter.OutputModeFlow {
+				logrus.Fatalf("%d tasks failed, failed inputs are listed in filter summaries", failed)
+			}
+			logrus.Fatalf("%d tasks failed, failed inputs are listed in filter summaries. "+
+				"Rerun with --resume to redo them", failed)
+		}
+		// run is complete, so a later resume starts from scratch
+		if err := checkpoint.Remove(); err != nil {
+			logrus.Error(err)
+		}
 	},
 }
 
+// removeOutputs deletes partial outputs of a failed task
+func removeOutputs(result *filter.FilterResult) {
+	if result == nil {
+		return
+	}
+	for _, tr := range result.Targets {
+		for _, f := range tr.Files {
+			if err := os.Remove(f.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+// mergeParts merges filtered parts of a single filter into time ordered output
+func mergeParts(partsDir, outDir, name string, rotateBytes int64) []rotate.File {
+	parts, err := filepath.Glob(filepath.Join(partsDir, "*"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	sort.Strings(parts)
+	template := name + ".pcap"
+	if rotateBytes > 0 {
+		template = name + ".%t.pcap"
+	}
+	written, err := replay.MergeFiles(context.Background(), parts, rotate.Config{
+		Dir:      outDir,
+		Template: template,
+		Compress: viper.GetBool("filter.compress"),
+		MaxBytes: rotateBytes,
+	})
+	if err != nil {
+		logrus.Fatalf("Merging %s: %s", name, err)
+	}
+	for _, f := range written {
+		logrus.WithFields(logrus.Fields{
+			"filter":  name,
+			"path":    f.Path,
+			"packets": f.Packets,
+		}).Info("merged output written")
+	}
+	return written
+}
+
+// createDir ensures output directory exists
+func createDir(dir string) {
+	stat, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if err := os.Mkdir(dir, 0750); err != nil {
+			logrus.Fatal(err)
+		}
+	} else if err != nil {
+		logrus.Fatal(err)
+	} else if !stat.IsDir() {
+		logrus.Fatalf("Output path %s exists and is not a directory", dir)
+	}
+}
+
+// dedupFlags registers dedup window and key flags under given flag name and config key prefixes
+func dedupFlags(cmd *cobra.Command, flagPrefix, keyPrefix string) {
+	flags := cmd.PersistentFlags()
+
+	flags.Duration(flagPrefix+"window", dedup.DefaultWindow, `Upper bound of how long a packet is remembered for dedup, at least window minus one bucket span.`)
+	viper.BindPFlag(keyPrefix+"window", flags.Lookup(flagPrefix+"window"))
+
+	flags.Int(flagPrefix+"buckets", dedup.DefaultBuckets, `Number of buckets dedup window is split into. Oldest bucket expires as a whole.`)
+	viper.BindPFlag(keyPrefix+"buckets", flags.Lookup(flagPrefix+"buckets"))
+
+	flags.Int(flagPrefix+"bucket-size", dedup.DefaultBucketSize, `Hash slots per dedup bucket, each takes 8 bytes. Full bucket expires oldest one early.`)
+	viper.BindPFlag(keyPrefix+"bucket.size", flags.Lookup(flagPrefix+"bucket-size"))
+
+	flags.String(flagPrefix+"hash", dedup.AlgorithmFNV.String(), `Dedup key hash. Use fnv or md5.`)
+	viper.BindPFlag(keyPrefix+"hash", flags.Lookup(flagPrefix+"hash"))
+
+	flags.Bool(flagPrefix+"keep-ttl", false, `Include TTL and hop limit in dedup key, so copies seen after a router hop are kept.`)
+	viper.BindPFlag(keyPrefix+"keep.ttl", flags.Lookup(flagPrefix+"keep-ttl"))
+
+	flags.Bool(flagPrefix+"keep-l2", false, `Include MAC addresses and VLAN tags in dedup key.`)
+	viper.BindPFlag(keyPrefix+"keep.l2", flags.Lookup(flagPrefix+"keep-l2"))
+
+	flags.Bool(flagPrefix+"all-protocols", false, `Dedup ICMP and other IP protocols, not only TCP and UDP.`)
+	viper.BindPFlag(keyPrefix+"all.protocols", flags.Lookup(flagPrefix+"all-protocols"))
+
+	flags.Int(flagPrefix+"payload-bytes", 0, `Payload bytes after transport header added to dedup key. Negative for whole payload.`)
+	viper.BindPFlag(keyPrefix+"payload.bytes", flags.Lookup(flagPrefix+"payload-bytes"))
+
+	flags.Bool(flagPrefix+"inner", false, `Dedup on packets inside tunnels, even if output is not decapsulated.`)
+	viper.BindPFlag(keyPrefix+"inner", flags.Lookup(flagPrefix+"inner"))
+}
+
+// dedupEnabledArg reads dedup switch, older configs enable dedup with a boolean filter.dedup key
+func dedupEnabledArg() bool {
+	if enabled, ok := viper.Get("filter.dedup").(bool); ok {
+		logrus.Warn("Boolean filter.dedup config key is deprecated, use filter.dedup.enabled")
+		return enabled
+	}
+	return viper.GetBool("filter.dedup.enabled")
+}
+
+// dedupConfigArg builds dedup config from flags registered by dedupFlags, exits on invalid hash
+func dedupConfigArg(keyPrefix string) dedup.WindowConfig {
+	algorithm, err := dedup.NewAlgorithm(viper.GetString(keyPrefix + "hash"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return dedup.WindowConfig{
+		Window:     viper.GetDuration(keyPrefix + "window"),
+		Buckets:    viper.GetInt(keyPrefix + "buckets"),
+		BucketSize: viper.GetInt(keyPrefix + "bucket.size"),
+		Key: dedup.KeyConfig{
+			KeepTTL:      viper.GetBool(keyPrefix + "keep.ttl"),
+			KeepL2:       viper.GetBool(keyPrefix + "keep.l2"),
+			AllProtocols: viper.GetBool(keyPrefix + "all.protocols"),
+			PayloadBytes: viper.GetInt(keyPrefix + "payload.bytes"),
+			Algorithm:    algorithm,
+		},
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(filterCmd)
 
@@ -220,21 +622,67 @@ func init() {
 	filterCmd.PersistentFlags().String("output", "", `Output folder for filtered PCAP files.`)
 	viper.BindPFlag("filter.output", filterCmd.PersistentFlags().Lookup("output"))
 
-	filterCmd.PersistentFlags().Bool("decap", false, `Decapsulate GRE and ERSPAN headers.`)
+	filterCmd.PersistentFlags().String("output-mode", filter.OutputModeInput.String(),
+		`Output layout. Use input for one file per input, merged for one time ordered file per filter, or flow for one file per flow named by 5-tuple. Flow output needs a single worker and reads inputs in name order.`)
+	viper.BindPFlag("filter.mode.output", filterCmd.PersistentFlags().Lookup("output-mode"))
+
+	filterCmd.PersistentFlags().Int64("rotate-mb", 0, `Rotate input or merged output files once they reach this size in megabytes. 0 disables rotation.`)
+	viper.BindPFlag("filter.rotate.mb", filterCmd.PersistentFlags().Lookup("rotate-mb"))
+
+	filterCmd.PersistentFlags().Int("flow-max-open", filter.DefaultFlowMaxOpen, `Max number of per-flow output files kept open at once.`)
+	viper.BindPFlag("filter.flow.max.open", filterCmd.PersistentFlags().Lookup("flow-max-open"))
+
+	filterCmd.PersistentFlags().Bool("resume", false, `Skip tasks recorded as completed in checkpoint file of an interrupted run. Partially written outputs are redone.`)
+	viper.BindPFlag("filter.resume", filterCmd.PersistentFlags().Lookup("resume"))
+
+	filterCmd.PersistentFlags().String("checkpoint", "", `Checkpoint file for completed tasks. Defaults to `+filter.CheckpointFile+` in output folder.`)
+	viper.BindPFlag("filter.checkpoint", filterCmd.PersistentFlags().Lookup("checkpoint"))
+
+	filterCmd.PersistentFlags().Bool("single-pass", false, `Read each input file once and evaluate all filters on each packet, instead of one task per input and filter.`)
+	viper.BindPFlag("filter.single.pass", filterCmd.PersistentFlags().Lookup("single-pass"))
+
+	filterCmd.PersistentFlags().Bool("decap", false, `Decapsulate GRE, ERSPAN, VXLAN, GENEVE, IP-in-IP, GTP-U and MPLS over GRE tunnels, including nested ones. Input must be ethernet.`)
 	viper.BindPFlag("filter.decap.enabled", filterCmd.PersistentFlags().Lookup("decap"))
 
 	filterCmd.PersistentFlags().Int("decap-depth", -1, `Max posterior packet layers to check for decap.`)
 	viper.BindPFlag("filter.decap.depth", filterCmd.PersistentFlags().Lookup("decap-depth"))
 
+	filterCmd.PersistentFlags().Bool("pcapng", false, `Write pcapng instead of pcap. With decap, outer tunnel endpoints and IDs are kept as packet comments.`)
+	viper.BindPFlag("filter.pcapng", filterCmd.PersistentFlags().Lookup("pcapng"))
+
+	filterCmd.PersistentFlags().Bool("split-tunnel", false, `Write separate output per ERSPAN session ID or VXLAN and GENEVE VNI. Needs decap.`)
+	viper.BindPFlag("filter.split.tunnel", filterCmd.PersistentFlags().Lookup("split-tunnel"))
+
+	filterCmd.PersistentFlags().Bool("strip-vlan", false, `Remove VLAN and QinQ tags from written packets.`)
+	viper.BindPFlag("filter.strip.vlan", filterCmd.PersistentFlags().Lookup("strip-vlan"))
+
+	filterCmd.PersistentFlags().Bool("strip-mpls", false, `Remove MPLS labels from written packets with IP payload.`)
+	viper.BindPFlag("filter.strip.mpls", filterCmd.PersistentFlags().Lookup("strip-mpls"))
+
 	filterCmd.PersistentFlags().Bool("compress", false, `Write output packets directly to gzip stream.`)
 	viper.BindPFlag("filter.compress", filterCmd.PersistentFlags().Lookup("compress"))
 
-	filterCmd.PersistentFlags().Bool("dedup", false, `Apply best-effort software dedup.`)
-	viper.BindPFlag("filter.dedup", filterCmd.PersistentFlags().Lookup("dedup"))
+	filterCmd.PersistentFlags().Bool("dedup", false, `Drop packets already seen within dedup window, measured in packet time.`)
+	viper.BindPFlag("filter.dedup.enabled", filterCmd.PersistentFlags().Lookup("dedup"))
+
+	dedupFlags(filterCmd, "dedup-", "filter.dedup.")
 
 	filterCmd.PersistentFlags().String("maxmind-asn", "", `Path to maxmind ASN database. Only needed if ASN filter is used.`)
 	viper.BindPFlag("filter.maxmind.asn", filterCmd.PersistentFlags().Lookup("maxmind-asn"))
 
+	filterCmd.PersistentFlags().String("maxmind-country", "", `Path to maxmind Country database. Only needed if country or continent filter is used.`)
+	viper.BindPFlag("filter.maxmind.country", filterCmd.PersistentFlags().Lookup("maxmind-country"))
+
+	filterCmd.PersistentFlags().String("maxmind-city", "", `Path to maxmind City database. Only needed if city filter is used, can also serve country and continent filters.`)
+	viper.BindPFlag("filter.maxmind.city", filterCmd.PersistentFlags().Lookup("maxmind-city"))
+
+	filterCmd.PersistentFlags().String("flow-mode", filter.FlowModePacket.String(),
+		`Keep whole flows once a packet matches. Use packet, follow or two-pass. Follow keeps packets after first match, two-pass reads input twice to also keep earlier packets. Flow state does not carry across input files, so a session split across rotated pcaps is only partly recovered.`)
+	viper.BindPFlag("filter.flow.mode", filterCmd.PersistentFlags().Lookup("flow-mode"))
+
+	filterCmd.PersistentFlags().Duration("flow-timeout", filter.DefaultFlowTimeout, `Idle timeout for flows tracked by sticky conditions and follow flow mode.`)
+	viper.BindPFlag("filter.flow.timeout", filterCmd.PersistentFlags().Lookup("flow-timeout"))
+
 	filterCmd.PersistentFlags().String("suffix", "pcap", "Find files with following suffix.")
 	viper.BindPFlag("filter.suffix", filterCmd.PersistentFlags().Lookup("suffix"))
 }
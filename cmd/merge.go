@@ -0,0 +1,132 @@
+/*
+Copyright © 2020 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/replay"
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// mergeCmd represents the merge command
+var mergeCmd = &cobra.Command{
+	Use:   "merge",
+	Short: "Merge mapped pcap set into a single time ordered output.",
+	Long: `Load metadata for PCAP dataset and write all packets into a single pcap file, sorted by
+timestamp across all input files. Files are opened only when merged stream reaches their
+beginning. Gzipped inputs are handled natively. Output can be rotated by size or duration,
+in which case file name must contain %t for unix timestamp of first packet in each file.
+
+Example usage:
+gopherCap merge \
+	--dump-json /mnt/pcap/meta.json \
+	--out-file /mnt/merged.pcap
+
+Merge a time window and rotate output every 100 megabytes:
+gopherCap merge \
+	--dump-json /mnt/pcap/meta.json \
+	--file-regexp '200928+-\d+' \
+	--time-from "2020-09-28 06:00:00" \
+	--time-to "2020-09-28 16:00:00" \
+	--out-file "/mnt/merged/merged.%t.pcap" \
+	--rotate-mb 100
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		set, err := replay.LoadSetJSON(viper.GetString("global.dump.json"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		out := viper.GetString("merge.out.file")
+		if out == "" {
+			logrus.Fatal("Missing output file")
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		chSIG := make(chan os.Signal, 1)
+		signal.Notify(chSIG, os.Interrupt)
+		go func() {
+			<-chSIG
+			cancel()
+		}()
+
+		start := time.Now()
+		files, err := replay.Merge(replay.MergeConfig{
+			Set:         *set,
+			FilterRegex: fileRegexpArg(),
+			TimeFrom:    timestampArg("merge.time.from"),
+			TimeTo:      timestampArg("merge.time.to"),
+			Ctx:         ctx,
+			Output: rotate.Config{
+				Dir:         filepath.Dir(out),
+				Template:    filepath.Base(out),
+				Compress:    viper.GetBool("merge.out.gzip"),
+				MaxBytes:    viper.GetInt64("merge.rotate.mb") * 1024 * 1024,
+				MaxDuration: viper.GetDuration("merge.rotate.duration"),
+			},
+		})
+		for _, f := range files {
+			logrus.WithFields(logrus.Fields{
+				"path":      f.Path,
+				"packets":   f.Packets,
+				"bytes":     f.Bytes,
+				"beginning": f.Beginning,
+				"end":       f.End,
+			}).Info("file written")
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Merge done in %s.", time.Since(start))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mergeCmd)
+
+	mergeCmd.PersistentFlags().String("out-file", "",
+		`Output pcap file. Must contain %t if rotation is enabled.`)
+	viper.BindPFlag("merge.out.file", mergeCmd.PersistentFlags().Lookup("out-file"))
+
+	mergeCmd.PersistentFlags().Bool("out-gzip", false,
+		`Compress output with gzip.`)
+	viper.BindPFlag("merge.out.gzip", mergeCmd.PersistentFlags().Lookup("out-gzip"))
+
+	mergeCmd.Flags().String(
+		"time-from", "", `Drop packets before this time.`)
+	viper.BindPFlag("merge.time.from", mergeCmd.Flags().Lookup("time-from"))
+
+	mergeCmd.Flags().String(
+		"time-to", "", `Drop packets after this time.`)
+	viper.BindPFlag("merge.time.to", mergeCmd.Flags().Lookup("time-to"))
+
+	mergeCmd.PersistentFlags().Int64("rotate-mb", 0,
+		`Rotate output file once it reaches this size in megabytes, counted before compression. 0 disables.`)
+	viper.BindPFlag("merge.rotate.mb", mergeCmd.PersistentFlags().Lookup("rotate-mb"))
+
+	mergeCmd.PersistentFlags().Duration("rotate-duration", 0,
+		`Rotate output file once packet timestamps span over this duration. 0 disables.`)
+	viper.BindPFlag("merge.rotate.duration", mergeCmd.PersistentFlags().Lookup("rotate-duration"))
+}
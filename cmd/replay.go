@@ -30,6 +30,30 @@ import (
 
 const argTsFormat = "2006-01-02 15:04:05"
 
+// fileRegexpArg compiles optional global file name pattern, exits on invalid pattern
+func fileRegexpArg() *regexp.Regexp {
+	if pattern := viper.GetString("global.file.regexp"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return re
+	}
+	return nil
+}
+
+// timestampArg parses optional timestamp from viper key, exits on invalid format
+func timestampArg(key string) time.Time {
+	if raw := viper.GetString(key); raw != "" {
+		ts, err := time.Parse(argTsFormat, raw)
+		if err != nil {
+			logrus.Fatalf("Invalid timestamp %s, please follow this format: %s", raw, argTsFormat)
+		}
+		return ts.UTC()
+	}
+	return time.Time{}
+}
+
 // replayCmd represents the replay command
 var replayCmd = &cobra.Command{
 	Use:   "replay",
@@ -53,6 +77,13 @@ gopherCap replay \
 	--time-to "2020-09-28 16:00:00" \
 	--out-bpf "not net 10.0.0.0/32"
 
+Loop over the set 10 times with a 30 second pause between iterations:
+gopherCap replay \
+	--out-interface veth0 \
+	--dump-json "db/mapped-files.json"
+	--loop-count 10 \
+	--loop-pause 30s
+
 Usage timescaling to replay 1 day pcap set (approximately) in 4 hours:
 gopherCap replay \
 	--out-interface veth0 \
@@ -61,6 +92,12 @@ gopherCap replay \
 	--time-scale-enabled \
 	--time-scale-duration 4h
 
+Replay old dataset into a pcap file as if it was captured starting now:
+gopherCap replay \
+	--out-pcap /tmp/replayed.pcap \
+	--dump-json "db/mapped-files.json"
+	--time-rewrite
+
 Set up virtual ethernet interface for testing or local capture:
 sudo ip link add veth0 type veth peer name veth1
 
@@ -82,73 +119,42 @@ FATA[0005] send: Message too long
 		if iterations < 1 || viper.GetBool("replay.loop.infinite") {
 			logrus.Infof("Negative iteration count or --loop-infinite called. Enabling infinite loop.")
 		}
-		var count int
-	loop:
-		for {
-			count++
-			if !viper.GetBool("replay.loop.infinite") && count > iterations {
-				if iterations > 1 {
-					logrus.Infof("Max iteration count %d reached. Stopping loop.", iterations)
-				}
-				break loop
-			}
-			logrus.Infof("Starting iteration %d", count)
-			handle, err := replay.NewHandle(replay.Config{
-				Set:            *set,
-				Ctx:            context.Background(),
-				WriteInterface: viper.GetString("replay.out.interface"),
-				ScaleDuration:  viper.GetDuration("replay.time.scale.duration"),
-				ScaleEnabled:   viper.GetBool("replay.time.scale.enabled"),
-				ScalePerFile:   viper.GetBool("replay.disable_wait"),
-				OutBpf:         viper.GetString("replay.out.bpf"),
-				DisableWait:    viper.GetBool("replay.disable_wait"),
-				SkipOutOfOrder: viper.GetBool("replay.skip.out_of_order"),
-				SkipMTU:        viper.GetInt("replay.skip.mtu"),
-				Reorder:        viper.GetBool("replay.reorder.enabled"),
-				FilterRegex: func() *regexp.Regexp {
-					if pattern := viper.GetString("global.file.regexp"); pattern != "" {
-						re, err := regexp.Compile(pattern)
-						if err != nil {
-							logrus.Fatal(err)
-						}
-						return re
-					}
-					return nil
-				}(),
-				TimeFrom: func() time.Time {
-					if from := viper.GetString("replay.time.from"); from != "" {
-						ts, err := time.Parse(argTsFormat, from)
-						if err != nil {
-							logrus.Fatalf("Invalid timestamp %s, please follow this format: %s", from, argTsFormat)
-						}
-						return ts.UTC()
-					}
-					return time.Time{}
-				}(),
-				TimeTo: func() time.Time {
-					if from := viper.GetString("replay.time.to"); from != "" {
-						ts, err := time.Parse(argTsFormat, from)
-						if err != nil {
-							logrus.Fatalf("Invalid timestamp %s, please follow this format: %s", from, argTsFormat)
-						}
-						return ts.UTC()
-					}
-					return time.Time{}
-				}(),
-			})
-			if err != nil {
-				logrus.Fatal(err)
-			}
-			logrus.WithFields(logrus.Fields{
-				"beginning": handle.FileSet.Beginning,
-				"end":       handle.FileSet.End,
-			}).Info("PCAP set loaded")
-			start := time.Now()
-			if err := handle.Play(); err != nil {
-				logrus.Fatal(err)
-			}
-			logrus.Infof("Iteration %d done in %s.", count, time.Since(start))
+		handle, err := replay.NewHandle(replay.Config{
+			Set:               *set,
+			Ctx:               context.Background(),
+			WriteInterface:    viper.GetString("replay.out.interface"),
+			WriteFile:         viper.GetString("replay.out.pcap"),
+			ScaleDuration:     viper.GetDuration("replay.time.scale.duration"),
+			ScaleEnabled:      viper.GetBool("replay.time.scale.enabled"),
+			ScalePerFile:      viper.GetBool("replay.disable_wait"),
+			OutBpf:            viper.GetString("replay.out.bpf"),
+			DisableWait:       viper.GetBool("replay.disable_wait"),
+			SkipOutOfOrder:    viper.GetBool("replay.skip.out_of_order"),
+			SkipMTU:           viper.GetInt("replay.skip.mtu"),
+			Decapsulate:       viper.GetBool("replay.decap"),
+			Reorder:           viper.GetBool("replay.reorder.enabled"),
+			LoopCount:         iterations,
+			LoopInfinite:      viper.GetBool("replay.loop.infinite"),
+			LoopPause:         viper.GetDuration("replay.loop.pause"),
+			LoopOverlap:       viper.GetDuration("replay.loop.overlap"),
+			RewriteTimestamps: viper.GetBool("replay.time.rewrite.enabled"),
+			RewriteEpoch:      timestampArg("replay.time.rewrite.epoch"),
+			FilterRegex:       fileRegexpArg(),
+			TimeFrom:          timestampArg("replay.time.from"),
+			TimeTo:            timestampArg("replay.time.to"),
+		})
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"beginning": handle.FileSet.Beginning,
+			"end":       handle.FileSet.End,
+		}).Info("PCAP set loaded")
+		start := time.Now()
+		if err := handle.Play(); err != nil {
+			logrus.Fatal(err)
 		}
+		logrus.Infof("Replay done in %s.", time.Since(start))
 	},
 }
 
@@ -159,6 +165,10 @@ func init() {
 		`Network interface to replay to.`)
 	viper.BindPFlag("replay.out.interface", replayCmd.PersistentFlags().Lookup("out-interface"))
 
+	replayCmd.PersistentFlags().String("out-pcap", "",
+		`Replay into a pcap file instead of network interface. Will override --out-interface.`)
+	viper.BindPFlag("replay.out.pcap", replayCmd.PersistentFlags().Lookup("out-pcap"))
+
 	replayCmd.PersistentFlags().String("out-bpf", "",
 		`BPF filter to exclude some packets.`)
 	viper.BindPFlag("replay.out.bpf", replayCmd.PersistentFlags().Lookup("out-bpf"))
@@ -171,6 +181,15 @@ func init() {
 		`Number of iterations over pcap set. Will run infinitely if 0 or negative value is given.`)
 	viper.BindPFlag("replay.loop.count", replayCmd.PersistentFlags().Lookup("loop-count"))
 
+	replayCmd.PersistentFlags().Duration("loop-pause", 0,
+		`Pause between loop iterations. Output interface is kept open during the pause.`)
+	viper.BindPFlag("replay.loop.pause", replayCmd.PersistentFlags().Lookup("loop-pause"))
+
+	replayCmd.PersistentFlags().Duration("loop-overlap", 0,
+		`Start next loop iteration this long before current one is expected to finish. `+
+			`Overlapping iterations are written to the same output.`)
+	viper.BindPFlag("replay.loop.overlap", replayCmd.PersistentFlags().Lookup("loop-overlap"))
+
 	replayCmd.Flags().String(
 		"time-from", "", `Start replay from this time.`)
 	viper.BindPFlag("replay.time.from", replayCmd.Flags().Lookup("time-from"))
@@ -179,6 +198,15 @@ func init() {
 		"time-to", "", `End replay from this time.`)
 	viper.BindPFlag("replay.time.to", replayCmd.Flags().Lookup("time-to"))
 
+	replayCmd.PersistentFlags().Bool("time-rewrite", false,
+		`Shift packet timestamps so that replayed set appears to be captured starting from --time-rewrite-epoch. `+
+			`Inter-packet gaps are preserved. Only affects --out-pcap.`)
+	viper.BindPFlag("replay.time.rewrite.enabled", replayCmd.PersistentFlags().Lookup("time-rewrite"))
+
+	replayCmd.PersistentFlags().String("time-rewrite-epoch", "",
+		`New beginning for rewritten timestamps. Current time is used if empty.`)
+	viper.BindPFlag("replay.time.rewrite.epoch", replayCmd.PersistentFlags().Lookup("time-rewrite-epoch"))
+
 	replayCmd.PersistentFlags().Bool("time-scale-enabled", false,
 		`Enable time scaling. `+
 			`Actual replay is not guaranteed to complete in defined time, `+
@@ -191,7 +219,8 @@ func init() {
 
 	replayCmd.PersistentFlags().Bool("wait-disable", false,
 		`Disable initial wait before each PCAP file read. `+
-			`Useful when PCAPs are part of same logical set but not from same capture period.`)
+			`Useful when PCAPs are part of same logical set but not from same capture period. `+
+			`Not supported with --out-pcap, use merge subcommand instead.`)
 	viper.BindPFlag("replay.disable_wait", replayCmd.PersistentFlags().Lookup("wait-disable"))
 
 	replayCmd.PersistentFlags().Bool("skip-ooo", false, "Skip out of order packets. If disabled, out of order packets will be written with no delay.")
@@ -200,6 +229,9 @@ func init() {
 	replayCmd.PersistentFlags().Int("skip-mtu", 1514, "Packets with total size in bytes bigger than this value will be dropped.")
 	viper.BindPFlag("replay.skip.mtu", replayCmd.PersistentFlags().Lookup("skip-mtu"))
 
+	replayCmd.PersistentFlags().Bool("decap", false, "Remove tunnel headers and replay inner packets. Supports GRE, ERSPAN, VXLAN, GENEVE, IP-in-IP, GTP-U and MPLS over GRE. Input must be ethernet.")
+	viper.BindPFlag("replay.decap", replayCmd.PersistentFlags().Lookup("decap"))
+
 	replayCmd.PersistentFlags().Bool("reorder", false, "Enable packet reordering by timestamp. Adds overhead but is useful with out of order packets.")
 	viper.BindPFlag("replay.reorder.enabled", replayCmd.PersistentFlags().Lookup("reorder"))
 }
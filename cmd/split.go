@@ -0,0 +1,156 @@
+/*
+Copyright © 2020 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/replay"
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// splitCmd represents the split command
+var splitCmd = &cobra.Command{
+	Use:   "split",
+	Short: "Split pcap files by time, size, packet count or flow.",
+	Long: `Read pcap files and write packets into rotated output files. Input can be a single file or
+a folder, in which case all files are read in global timestamp order. Gzipped inputs are handled
+natively.
+
+Output file names follow Suricata style templates.
+- %n -- flow bucket number, or 0 if flow buckets are not used
+- %i -- same as %n
+- %t -- unix timestamp of first packet in file
+
+Default template matches default --file-format of extract subcommand, so split output can be fed
+back into extract. Note that extract tells files apart by second resolution timestamps.
+
+Example usage:
+gopherCap split \
+	--input /mnt/pcap/big.pcap \
+	--out-dir /mnt/split \
+	--rotate-duration 1m
+
+Distribute flows between 8 outputs, rotating each at 100 megabytes:
+gopherCap split \
+	--input /mnt/pcap \
+	--out-dir /mnt/split \
+	--flow-buckets 8 \
+	--rotate-mb 100
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		input := viper.GetString("split.input")
+		stat, err := os.Stat(input)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		files := []string{input}
+		if stat.IsDir() {
+			files, err = replay.FindPcapFiles(input, viper.GetString("split.suffix"))
+			if err != nil {
+				logrus.Fatalf("PCAP list gen: %s", err)
+			}
+		}
+		outDir := viper.GetString("split.out.dir")
+		if err := os.MkdirAll(outDir, 0750); err != nil {
+			logrus.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		chSIG := make(chan os.Signal, 1)
+		signal.Notify(chSIG, os.Interrupt)
+		go func() {
+			<-chSIG
+			cancel()
+		}()
+
+		start := time.Now()
+		written, err := replay.Split(replay.SplitConfig{
+			Files:       files,
+			FlowBuckets: viper.GetInt("split.flow.buckets"),
+			Ctx:         ctx,
+			Output: rotate.Config{
+				Dir:         outDir,
+				Template:    viper.GetString("split.out.template"),
+				Compress:    viper.GetBool("split.out.gzip"),
+				MaxBytes:    viper.GetInt64("split.rotate.mb") * 1024 * 1024,
+				MaxDuration: viper.GetDuration("split.rotate.duration"),
+				MaxPackets:  viper.GetInt("split.rotate.packets"),
+			},
+		})
+		for _, f := range written {
+			logrus.WithFields(logrus.Fields{
+				"path":      f.Path,
+				"packets":   f.Packets,
+				"bytes":     f.Bytes,
+				"beginning": f.Beginning,
+				"end":       f.End,
+			}).Info("file written")
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Split into %d files in %s.", len(written), time.Since(start))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(splitCmd)
+
+	splitCmd.PersistentFlags().String("input", "",
+		`Input pcap file or folder.`)
+	viper.BindPFlag("split.input", splitCmd.PersistentFlags().Lookup("input"))
+
+	splitCmd.PersistentFlags().String("suffix", "pcap",
+		`Find files with following suffix if input is a folder.`)
+	viper.BindPFlag("split.suffix", splitCmd.PersistentFlags().Lookup("suffix"))
+
+	splitCmd.PersistentFlags().String("out-dir", "",
+		`Output folder for split pcap files.`)
+	viper.BindPFlag("split.out.dir", splitCmd.PersistentFlags().Lookup("out-dir"))
+
+	splitCmd.PersistentFlags().String("out-template", "pcap.%n.%t",
+		`Output file name template.`)
+	viper.BindPFlag("split.out.template", splitCmd.PersistentFlags().Lookup("out-template"))
+
+	splitCmd.PersistentFlags().Bool("out-gzip", false,
+		`Compress output with gzip.`)
+	viper.BindPFlag("split.out.gzip", splitCmd.PersistentFlags().Lookup("out-gzip"))
+
+	splitCmd.PersistentFlags().Int64("rotate-mb", 0,
+		`Rotate output file once it reaches this size in megabytes. 0 disables.`)
+	viper.BindPFlag("split.rotate.mb", splitCmd.PersistentFlags().Lookup("rotate-mb"))
+
+	splitCmd.PersistentFlags().Duration("rotate-duration", 0,
+		`Rotate output file once packet timestamps span over this duration. 0 disables.`)
+	viper.BindPFlag("split.rotate.duration", splitCmd.PersistentFlags().Lookup("rotate-duration"))
+
+	splitCmd.PersistentFlags().Int("rotate-packets", 0,
+		`Rotate output file once it holds this many packets. 0 disables.`)
+	viper.BindPFlag("split.rotate.packets", splitCmd.PersistentFlags().Lookup("rotate-packets"))
+
+	splitCmd.PersistentFlags().Int("flow-buckets", 0,
+		`Distribute flows between this many outputs by 5-tuple hash. 0 disables.`)
+	viper.BindPFlag("split.flow.buckets", splitCmd.PersistentFlags().Lookup("flow-buckets"))
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2020 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/replay"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// timeshiftCmd represents the timeshift command
+var timeshiftCmd = &cobra.Command{
+	Use:   "timeshift",
+	Short: "Rewrite packet timestamps in a mapped pcap set.",
+	Long: `Load metadata for PCAP dataset and shift all packet timestamps by a fixed offset, or so
+that dataset begins at a new epoch. Same offset is applied to every file, so relative timing
+across files is preserved. Useful for aligning datasets before merging and for anonymising
+capture dates.
+
+Example usage:
+gopherCap timeshift \
+	--dump-json /mnt/pcap/meta.json \
+	--out-dir /mnt/shifted \
+	--offset -72h
+
+Move dataset to a new beginning and store metadata for shifted files:
+gopherCap timeshift \
+	--dump-json /mnt/pcap/meta.json \
+	--out-dir /mnt/shifted \
+	--epoch "2020-01-01 00:00:00" \
+	--out-json /mnt/shifted/meta.json
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		set, err := replay.LoadSetJSON(viper.GetString("global.dump.json"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if err := set.Subset(fileRegexpArg(), time.Time{}, time.Time{}); err != nil {
+			logrus.Fatal(err)
+		}
+		outDir := viper.GetString("timeshift.out.dir")
+		if err := os.MkdirAll(outDir, 0750); err != nil {
+			logrus.Fatal(err)
+		}
+		start := time.Now()
+		shifted, err := replay.ShiftSet(replay.ShiftConfig{
+			Set:      *set,
+			Offset:   viper.GetDuration("timeshift.offset"),
+			OutDir:   outDir,
+			Compress: viper.GetBool("timeshift.out.gzip"),
+			Workers:  viper.GetInt("timeshift.workers"),
+			Ctx:      context.Background(),
+			Epoch:    timestampArg("timeshift.epoch"),
+		})
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"beginning": shifted.Beginning,
+			"end":       shifted.End,
+			"took":      time.Since(start),
+		}).Info("PCAP set shifted")
+		if path := viper.GetString("timeshift.out.json"); path != "" {
+			if err := replay.DumpSetJSON(path, *shifted); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(timeshiftCmd)
+
+	timeshiftCmd.PersistentFlags().String("out-dir", "",
+		`Output directory for shifted pcap files.`)
+	viper.BindPFlag("timeshift.out.dir", timeshiftCmd.PersistentFlags().Lookup("out-dir"))
+
+	timeshiftCmd.PersistentFlags().Bool("out-gzip", false,
+		`Compress shifted files with gzip.`)
+	viper.BindPFlag("timeshift.out.gzip", timeshiftCmd.PersistentFlags().Lookup("out-gzip"))
+
+	timeshiftCmd.PersistentFlags().String("out-json", "",
+		`Store metadata for shifted files in JSON format. Can be used for replay or merge.`)
+	viper.BindPFlag("timeshift.out.json", timeshiftCmd.PersistentFlags().Lookup("out-json"))
+
+	timeshiftCmd.PersistentFlags().Duration("offset", 0,
+		`Duration added to each packet timestamp. Can be negative.`)
+	viper.BindPFlag("timeshift.offset", timeshiftCmd.PersistentFlags().Lookup("offset"))
+
+	timeshiftCmd.PersistentFlags().String("epoch", "",
+		`New beginning for the pcap set. Will override --offset.`)
+	viper.BindPFlag("timeshift.epoch", timeshiftCmd.PersistentFlags().Lookup("epoch"))
+
+	timeshiftCmd.PersistentFlags().Int("workers", 4,
+		`Number of pcap files to be shifted at once.`)
+	viper.BindPFlag("timeshift.workers", timeshiftCmd.PersistentFlags().Lookup("workers"))
+}
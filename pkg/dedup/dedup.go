@@ -2,8 +2,11 @@ package dedup
 
 import (
 	"crypto/md5"
-	"encoding/hex"
-	"time"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -13,122 +16,188 @@ import (
 // https://github.com/arkime/arkime/blob/main/capture/dedup.c#L57
 func HashMD5(pkt gopacket.Packet) []byte {
 	h := md5.New()
+	if !(KeyConfig{}).write(pkt, h) {
+		return nil
+	}
+	return h.Sum(nil)
+}
+
+// Hash64 uses same fields as HashMD5 with 64 bit FNV-1a, zero means packet should not be deduplicated
+func Hash64(pkt gopacket.Packet) uint64 {
+	sum, _ := NewHasher(KeyConfig{}).Sum64(pkt)
+	return sum
+}
+
+// Algorithm is hash function used for dedup keys
+type Algorithm int
+
+const (
+	// AlgorithmFNV is 64 bit FNV-1a, fast and good enough for dedup windows
+	AlgorithmFNV Algorithm = iota
+	// AlgorithmMD5 truncates MD5 to 64 bits, slower but well distributed on any input
+	AlgorithmMD5
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case AlgorithmMD5:
+		return "md5"
+	default:
+		return "fnv"
+	}
+}
+
+func NewAlgorithm(raw string) (Algorithm, error) {
+	switch raw {
+	case "", AlgorithmFNV.String():
+		return AlgorithmFNV, nil
+	case AlgorithmMD5.String():
+		return AlgorithmMD5, nil
+	default:
+		return AlgorithmFNV, fmt.Errorf("invalid dedup hash %s, use one of fnv, md5", raw)
+	}
+}
+
+// otherHeaderBytes is part of IP payload always hashed for protocols other than TCP and UDP
+const otherHeaderBytes = 8
+
+/*
+KeyConfig selects packet fields that make up dedup key. Zero value follows Arkime, hashing IP
+and TCP or UDP headers without TTL and checksum, so same packet seen on different capture
+points is a duplicate.
+*/
+type KeyConfig struct {
+	// KeepTTL includes IPv4 TTL and IPv6 hop limit
+	KeepTTL bool
+	// KeepL2 includes MAC addresses and VLAN tags
+	KeepL2 bool
+	// AllProtocols deduplicates ICMP and other IP protocols, not only TCP and UDP
+	AllProtocols bool
+	// PayloadBytes adds that many bytes of payload after transport header, negative for all.
+	// Transport checksum is then left out of the key.
+	PayloadBytes int
+	Algorithm    Algorithm
+}
+
+// write puts key fields into w, returns false if packet should not be deduplicated
+func (c KeyConfig) write(pkt gopacket.Packet, w io.Writer) bool {
+	var ip gopacket.Layer
 	for _, layer := range pkt.Layers() {
 		switch layer.LayerType() {
+		case layers.LayerTypeEthernet, layers.LayerTypeDot1Q:
+			if c.KeepL2 {
+				w.Write(layer.LayerContents())
+			}
 		case layers.LayerTypeIPv4:
 			data := layer.LayerContents()
-			h.Write(data[0:7])
-			// skip TTL
-			h.Write(data[9:9])
+			if len(data) < 20 {
+				return false
+			}
+			if c.KeepTTL {
+				w.Write(data[0:10])
+			} else {
+				w.Write(data[0:8])
+				// skip TTL
+				w.Write(data[9:10])
+			}
 			// skip checksum
-			h.Write(data[13:])
+			w.Write(data[12:])
+			ip = layer
 		case layers.LayerTypeIPv6:
 			data := layer.LayerContents()
-			h.Write(data[0:6])
-			// skip hop limit
-			h.Write(data[8:])
-		case layers.LayerTypeTCP, layers.LayerTypeUDP:
-			h.Write(layer.LayerContents())
-			// we only want TCP or UDP packets to be deduplicated
-			// hashing every packet could cause problems with ICMP or more obscure protocols
-			return h.Sum(nil)
+			if len(data) < 40 {
+				return false
+			}
+			if c.KeepTTL {
+				w.Write(data)
+			} else {
+				w.Write(data[0:7])
+				// skip hop limit
+				w.Write(data[8:])
+			}
+			ip = layer
+		case layers.LayerTypeTCP:
+			c.writeHeader(w, layer.LayerContents(), 16)
+			w.Write(c.payload(layer.LayerPayload()))
+			return true
+		case layers.LayerTypeUDP:
+			c.writeHeader(w, layer.LayerContents(), 6)
+			w.Write(c.payload(layer.LayerPayload()))
+			return true
 		}
 	}
-	return nil
-}
-
-// Dedupper is a subsystem that accepts a gopacket type and reports if it has been already seen
-type Dedupper interface {
-	// Drop implements Dedupper
-	Drop(gopacket.Packet) bool
+	// hashing every packet could cause problems with ICMP or more obscure protocols,
+	// so those are opt-in
+	if ip == nil || !c.AllProtocols {
+		return false
+	}
+	data := ip.LayerPayload()
+	if len(data) <= otherHeaderBytes {
+		w.Write(data)
+		return true
+	}
+	csum := -1
+	if pkt.Layer(layers.LayerTypeICMPv4) != nil || pkt.Layer(layers.LayerTypeICMPv6) != nil {
+		csum = 2
+	}
+	c.writeHeader(w, data[:otherHeaderBytes], csum)
+	w.Write(c.payload(data[otherHeaderBytes:]))
+	return true
 }
 
-// TrivialDedup is only a minimal prototype for simple testing and SHOULD NOT BE USED
-// It will leak memory and will likely see a high hash collision rate
-type TrivialDedup struct {
-	Set  map[string]bool
-	Hits uint64
+/*
+writeHeader skips 16 bit checksum at given offset when payload is part of the key. Checksum
+already covers whole payload, and is often wrong on hosts with checksum offload.
+*/
+func (c KeyConfig) writeHeader(w io.Writer, data []byte, csum int) {
+	if c.PayloadBytes == 0 || csum < 0 || len(data) < csum+2 {
+		w.Write(data)
+		return
+	}
+	w.Write(data[:csum])
+	w.Write(data[csum+2:])
 }
 
-// Drop implements Dedupper
-func (d *TrivialDedup) Drop(pkt gopacket.Packet) (found bool) {
-	if d.Set == nil {
-		// this object should not have a constructor
-		d.Set = make(map[string]bool)
+func (c KeyConfig) payload(data []byte) []byte {
+	if c.PayloadBytes >= 0 && len(data) > c.PayloadBytes {
+		return data[:c.PayloadBytes]
 	}
-	h := HashMD5(pkt)
-	if h == nil {
-		return false
-	}
-	key := hex.EncodeToString(h)
-	if d.Set[key] {
-		found = true
-		d.Hits++
-	}
-	d.Set[key] = true
-	return found
+	return data
 }
 
-// CircularDedup maintains N buckets of hash sets
-// hash lookup is done from all
-// if hash is not found, add to latest
-// rotate buckets if bucket duration has passed
-type CircularDedup struct {
-	// circular array of hash sets
-	Buckets []map[string]bool
-	// max number of buckets to be kept
-	MaxBuckets int
-	// max duration of each bucket
-	Duration time.Duration
-	// timestamp of latest bucket
-	Bucket time.Time
+// Hasher computes 64 bit dedup keys, not safe for concurrent use
+type Hasher struct {
+	key KeyConfig
+	h   hash.Hash
+	buf []byte
 }
 
-func (cd *CircularDedup) Drop(pkt gopacket.Packet) (found bool) {
-	count := len(cd.Buckets)
-	if count == 0 {
-		cd.Buckets = make([]map[string]bool, 0, cd.MaxBuckets)
-		cd.Buckets[0] = make(map[string]bool)
-	}
-	h := HashMD5(pkt)
-	if h == nil {
-		return false
+func NewHasher(c KeyConfig) *Hasher {
+	hs := &Hasher{key: c, buf: make([]byte, 0, md5.Size)}
+	switch c.Algorithm {
+	case AlgorithmMD5:
+		hs.h = md5.New()
+	default:
+		hs.h = fnv.New64a()
 	}
-	key := hex.EncodeToString(h)
-	for _, bucket := range cd.Buckets {
-		if bucket[key] {
-			found = true
-		}
-	}
-	if !found {
-		cd.Buckets[len(cd.Buckets)-1][key] = true
-	}
-	// check if new bucket needs to be added
-	if time.Since(cd.Bucket) > cd.Duration {
-		cd.Buckets = append(cd.Buckets, map[string]bool{})
-		cd.Bucket = time.Now().Truncate(cd.Duration)
-		// drop last bucket if oversized
-		if count+1 > cd.MaxBuckets {
-			cd.Buckets = cd.Buckets[1:]
-		}
-	}
-	return found
+	return hs
 }
 
-func NewCircularDedup(max int, duration time.Duration) *CircularDedup {
-	cd := &CircularDedup{}
-	if max < 2 {
-		cd.MaxBuckets = 2
-	} else {
-		cd.MaxBuckets = max
+// Sum64 returns non-zero key for packet, or false if packet should not be deduplicated
+func (hs *Hasher) Sum64(pkt gopacket.Packet) (uint64, bool) {
+	hs.h.Reset()
+	if !hs.key.write(pkt, hs.h) {
+		return 0, false
 	}
-	if duration == 0 {
-		cd.Duration = 2 * time.Second
-	} else {
-		cd.Duration = duration
+	hs.buf = hs.h.Sum(hs.buf[:0])
+	if sum := binary.BigEndian.Uint64(hs.buf); sum != 0 {
+		return sum, true
 	}
-	cd.Buckets = make([]map[string]bool, 1, max)
-	cd.Buckets[0] = make(map[string]bool)
-	cd.Bucket = time.Now().Truncate(cd.Duration)
-	return cd
+	return 1, true
+}
+
+// Dedupper is a subsystem that accepts a gopacket type and reports if it has been already seen
+type Dedupper interface {
+	// Drop implements Dedupper
+	Drop(gopacket.Packet) bool
 }
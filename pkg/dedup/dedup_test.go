@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -124,3 +125,127 @@ func TestHashV4(t *testing.T) {
 		t.Fatal("dest IP change should change hash result")
 	}
 }
+
+func TestWindowDedup(t *testing.T) {
+	d, err := NewWindowDedup(WindowConfig{Window: 2 * time.Second, Buckets: 2, BucketSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buildPacketIPv4(v4params{pktParams: pktParams{
+		srcIP:    net.IP{127, 0, 0, 1},
+		destIP:   net.IP{8, 8, 8, 8},
+		srcMAC:   net.HardwareAddr{0xFF, 0xAA, 0xFA, 0xAA, 0xFF, 0xAA},
+		destMac:  net.HardwareAddr{0xBD, 0xBD, 0xBD, 0xBD, 0xBD, 0xAA},
+		srcPort:  29999,
+		destPort: 80,
+		ttl:      64,
+	}})
+	start := time.Unix(1600000000, 0)
+	at := func(offset time.Duration) gopacket.Packet {
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		pkt.Metadata().Timestamp = start.Add(offset)
+		return pkt
+	}
+	if d.Drop(at(0)) {
+		t.Fatal("first packet should not be dropped")
+	}
+	if !d.Drop(at(500 * time.Millisecond)) {
+		t.Fatal("duplicate within window should be dropped")
+	}
+	// wall clock does not matter, only packet time
+	if d.Drop(at(5 * time.Second)) {
+		t.Fatal("duplicate outside window should not be dropped")
+	}
+	if d.Hits != 1 {
+		t.Fatalf("expected 1 hit, got %d", d.Hits)
+	}
+
+	// full buckets expire early instead of growing
+	for i := 0; i < 100; i++ {
+		d.seen(uint64(i+2), start.Add(5*time.Second))
+	}
+	if d.Overflows == 0 {
+		t.Fatal("expected bucket overflow")
+	}
+	for _, b := range d.buckets {
+		if len(b.slots) != 16 {
+			t.Fatal("bucket should not grow")
+		}
+	}
+	if _, err := NewWindowDedup(WindowConfig{Buckets: 1}); err == nil {
+		t.Fatal("single bucket should be rejected")
+	}
+}
+
+func TestKeyConfig(t *testing.T) {
+	build := func(ttl uint8, mac byte, payload string, proto layers.IPProtocol) gopacket.Packet {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      ttl,
+			SrcIP:    net.IP{10, 0, 0, 1},
+			DstIP:    net.IP{10, 0, 0, 2},
+			Protocol: proto,
+		}
+		var transport gopacket.SerializableLayer
+		if proto == layers.IPProtocolICMPv4 {
+			transport = &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}
+		} else {
+			udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+			udp.SetNetworkLayerForChecksum(ip)
+			transport = udp
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true},
+			&layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, mac},
+				DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+				EthernetType: layers.EthernetTypeIPv4,
+			},
+			ip, transport, gopacket.Payload(payload),
+		); err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	}
+	same := func(c KeyConfig, a, b gopacket.Packet) bool {
+		h := NewHasher(c)
+		ha, ok := h.Sum64(a)
+		if !ok {
+			t.Fatal("packet should be hashed")
+		}
+		hb, _ := h.Sum64(b)
+		return ha == hb
+	}
+	orig := build(64, 5, "abcd", layers.IPProtocolUDP)
+	for _, algo := range []Algorithm{AlgorithmFNV, AlgorithmMD5} {
+		c := KeyConfig{Algorithm: algo}
+		if !same(c, orig, build(63, 7, "abcd", layers.IPProtocolUDP)) {
+			t.Fatalf("%s: TTL and MAC should be ignored by default", algo)
+		}
+		if same(KeyConfig{Algorithm: algo, KeepTTL: true}, orig, build(63, 5, "abcd", layers.IPProtocolUDP)) {
+			t.Fatalf("%s: TTL should be part of key", algo)
+		}
+		if same(KeyConfig{Algorithm: algo, KeepL2: true}, orig, build(64, 7, "abcd", layers.IPProtocolUDP)) {
+			t.Fatalf("%s: MAC should be part of key", algo)
+		}
+	}
+	if same(KeyConfig{}, orig, build(64, 5, "abxx", layers.IPProtocolUDP)) {
+		t.Fatal("payload change should change key through checksum")
+	}
+	if !same(KeyConfig{PayloadBytes: 2}, orig, build(64, 5, "abxx", layers.IPProtocolUDP)) {
+		t.Fatal("only first payload bytes should be hashed")
+	}
+	if _, ok := NewHasher(KeyConfig{}).Sum64(build(64, 5, "", layers.IPProtocolICMPv4)); ok {
+		t.Fatal("ICMP should not be hashed by default")
+	}
+	icmp := build(64, 5, "abcd", layers.IPProtocolICMPv4)
+	if !same(KeyConfig{AllProtocols: true, PayloadBytes: 2}, icmp, build(64, 5, "abxx", layers.IPProtocolICMPv4)) {
+		t.Fatal("only first payload bytes should be hashed")
+	}
+	if same(KeyConfig{AllProtocols: true, PayloadBytes: -1}, icmp, build(64, 5, "abxx", layers.IPProtocolICMPv4)) {
+		t.Fatal("whole payload should be hashed")
+	}
+	if a, err := NewAlgorithm("md5"); err != nil || a != AlgorithmMD5 {
+		t.Fatal("md5 algorithm not parsed")
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package dedup
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	DefaultWindow     = 2 * time.Second
+	DefaultBuckets    = 4
+	DefaultBucketSize = 1 << 18
+)
+
+// WindowConfig holds parameters for WindowDedup
+type WindowConfig struct {
+	/*
+		Window is upper bound of how long, in packet time, a packet is remembered. Buckets expire
+		as a whole, so a packet is remembered for at least Window minus one bucket span, less if
+		buckets overflow.
+	*/
+	Window time.Duration
+	// Buckets splits window into slots that expire together
+	Buckets int
+	// BucketSize is number of hash slots per bucket, rounded up to power of two
+	BucketSize int
+	// Key selects hashed packet fields
+	Key KeyConfig
+}
+
+/*
+Validate implements a standard interface for checking config struct validity and setting
+sane default values.
+*/
+func (c *WindowConfig) Validate() error {
+	if c.Window < 0 || c.Buckets < 0 || c.BucketSize < 0 {
+		return errors.New("dedup window, buckets and bucket size must not be negative")
+	}
+	if c.Window == 0 {
+		c.Window = DefaultWindow
+	}
+	if c.Buckets == 0 {
+		c.Buckets = DefaultBuckets
+	}
+	if c.BucketSize == 0 {
+		c.BucketSize = DefaultBucketSize
+	}
+	if c.Buckets < 2 {
+		return errors.New("dedup needs at least 2 buckets")
+	}
+	if c.BucketSize < 16 {
+		return errors.New("dedup bucket size must be at least 16")
+	}
+	if c.Window/time.Duration(c.Buckets) == 0 {
+		return errors.New("dedup window too short for bucket count")
+	}
+	return nil
+}
+
+// MemoryBytes is upper bound of hash table memory used by a single dedupper
+func (c WindowConfig) MemoryBytes() int {
+	return c.Buckets * tableSize(c.BucketSize) * 8
+}
+
+/*
+WindowDedup remembers 64 bit packet hashes for a sliding window of packet time, so results
+do not depend on how fast input is read. Window is split into a ring of buckets, each a
+fixed size open addressing hash table. Oldest bucket is cleared and reused when packet time
+moves past current bucket, or early when current bucket fills up, so memory use is fixed
+regardless of packet rate.
+*/
+type WindowDedup struct {
+	// Hits counts dropped packets
+	Hits uint64
+	// Overflows counts buckets rotated before their time because they were full
+	Overflows uint64
+
+	buckets []table
+	current int
+	span    time.Duration
+	start   time.Time
+	hasher  *Hasher
+}
+
+// NewWindowDedup creates dedupper with all hash tables allocated up front
+func NewWindowDedup(c WindowConfig) (*WindowDedup, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	d := &WindowDedup{
+		buckets: make([]table, c.Buckets),
+		span:    c.Window / time.Duration(c.Buckets),
+		hasher:  NewHasher(c.Key),
+	}
+	for i := range d.buckets {
+		d.buckets[i] = newTable(c.BucketSize)
+	}
+	return d, nil
+}
+
+// Drop implements Dedupper
+func (d *WindowDedup) Drop(pkt gopacket.Packet) bool {
+	h, ok := d.hasher.Sum64(pkt)
+	if !ok {
+		return false
+	}
+	return d.seen(h, pkt.Metadata().Timestamp)
+}
+
+// seen checks hash against all buckets and records it in current one if not found
+func (d *WindowDedup) seen(h uint64, ts time.Time) bool {
+	if h == 0 {
+		h = 1
+	}
+	d.advance(ts)
+	for i := range d.buckets {
+		if d.buckets[i].contains(h) {
+			d.Hits++
+			return true
+		}
+	}
+	if d.buckets[d.current].full() {
+		d.Overflows++
+		d.rotate()
+	}
+	d.buckets[d.current].insert(h)
+	return false
+}
+
+// advance rotates buckets to packet time, packets going back in time stay in current bucket
+func (d *WindowDedup) advance(ts time.Time) {
+	if d.start.IsZero() {
+		d.start = ts.Truncate(d.span)
+		return
+	}
+	if ts.Sub(d.start) < d.span {
+		return
+	}
+	steps := int(ts.Sub(d.start) / d.span)
+	if steps > len(d.buckets) {
+		steps = len(d.buckets)
+	}
+	for i := 0; i < steps; i++ {
+		d.rotate()
+	}
+	d.start = ts.Truncate(d.span)
+}
+
+func (d *WindowDedup) rotate() {
+	d.current = (d.current + 1) % len(d.buckets)
+	d.buckets[d.current].reset()
+}
+
+// table is open addressing set of non-zero hashes with linear probing
+type table struct {
+	slots []uint64
+	count int
+	limit int
+}
+
+func tableSize(size int) int {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return n
+}
+
+func newTable(size int) table {
+	n := tableSize(size)
+	// keep probe sequences short
+	return table{slots: make([]uint64, n), limit: n / 4 * 3}
+}
+
+func (t *table) contains(h uint64) bool {
+	if t.count == 0 {
+		return false
+	}
+	mask := uint64(len(t.slots) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		switch t.slots[i] {
+		case h:
+			return true
+		case 0:
+			return false
+		}
+	}
+}
+
+func (t *table) insert(h uint64) {
+	mask := uint64(len(t.slots) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		switch t.slots[i] {
+		case h:
+			return
+		case 0:
+			t.slots[i] = h
+			t.count++
+			return
+		}
+	}
+}
+
+func (t table) full() bool { return t.count >= t.limit }
+
+func (t *table) reset() {
+	if t.count == 0 {
+		return
+	}
+	for i := range t.slots {
+		t.slots[i] = 0
+	}
+	t.count = 0
+}
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/StamusNetworks/gophercap/pkg/filter"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/sirupsen/logrus"
@@ -102,29 +103,21 @@ func buildEndpoints(event Event) (*FlowPair, error) {
 
 func filterTunnel(data []byte, eventFLowPair FlowPair, event Event) bool {
 	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Lazy)
+	if event.Tunnel.Depth > 0 {
+		inner, info, err := filter.Decapsulate(packet, 0)
+		if err != nil || info.Depth() == 0 {
+			logrus.Debugf("Unable to decapsulate %s tunnel: %v", event.Tunnel.Proto, err)
+			return false
+		}
+		packet = inner
+	}
 	switch event.Proto {
 	case "TCP":
 		tcpLayer := packet.Layer(layers.LayerTypeTCP)
 		if tcpLayer != nil {
 			tcp, _ := tcpLayer.(*layers.TCP)
 			if tcp.TransportFlow() == *eventFLowPair.Transport || tcp.TransportFlow() == eventFLowPair.Transport.Reverse() {
-				/* TODO handle depth > 1 */
-				networkLayer := packet.NetworkLayer()
-				if event.Tunnel.Depth > 0 {
-					var tLayer gopacket.Layer
-					switch event.Tunnel.Proto {
-					case "GRE":
-						tLayer = packet.Layer(layers.LayerTypeGRE)
-					case "VXLAN":
-						tLayer = packet.Layer(layers.LayerTypeVXLAN)
-					default:
-						logrus.Error("Unsupported tunnel type: " + event.Tunnel.Proto)
-						return false
-					}
-					actualPacket := gopacket.NewPacket(tLayer.LayerPayload(), layers.LayerTypeIPv4, gopacket.Lazy)
-					networkLayer = actualPacket.NetworkLayer()
-				}
-				nFlow := networkLayer.NetworkFlow()
+				nFlow := packet.NetworkLayer().NetworkFlow()
 				if nFlow == *eventFLowPair.IP || nFlow == eventFLowPair.IP.Reverse() {
 					return true
 				}
@@ -132,7 +125,6 @@ func filterTunnel(data []byte, eventFLowPair FlowPair, event Event) bool {
 		}
 	case "UDP":
 		udpLayer := packet.Layer(layers.LayerTypeUDP)
-		/* TODO handle tunnel in UDP */
 		if udpLayer != nil {
 			udp, _ := udpLayer.(*layers.UDP)
 			if udp.TransportFlow() == *eventFLowPair.Transport || udp.TransportFlow() == eventFLowPair.Transport.Reverse() {
@@ -141,7 +133,6 @@ func filterTunnel(data []byte, eventFLowPair FlowPair, event Event) bool {
 		}
 	case "SCTP":
 		sctpLayer := packet.Layer(layers.LayerTypeSCTP)
-		/* TODO handle tunnel in SCTP */
 		if sctpLayer != nil {
 			sctp, _ := sctpLayer.(*layers.SCTP)
 			if sctp.TransportFlow() == *eventFLowPair.Transport || sctp.TransportFlow() == eventFLowPair.Transport.Reverse() {
@@ -0,0 +1,268 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type namePattern struct {
+	exact  string
+	suffix string
+	glob   string
+}
+
+/*
+NameMatcher matches domain names. Supported patterns are
+- example.com -- exact name
+- .example.com -- name and all subdomains
+- *.example.com -- subdomains only
+- ev?l*.example.com -- shell style glob
+Matching is case insensitive and trailing dots are ignored.
+*/
+type NameMatcher struct {
+	exact    map[string]bool
+	suffixes []namePattern
+}
+
+func NewNameMatcher(values []string) (*NameMatcher, error) {
+	if len(values) == 0 {
+		return nil, errors.New("no names to parse into condition")
+	}
+	nm := &NameMatcher{exact: make(map[string]bool), suffixes: make([]namePattern, 0)}
+	for _, raw := range values {
+		name := normalizeName(raw)
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("empty name pattern %q", raw)
+		case strings.HasPrefix(name, "*.") && !strings.ContainsAny(name[2:], "*?["):
+			nm.suffixes = append(nm.suffixes, namePattern{suffix: name[1:]})
+		case strings.HasPrefix(name, "."):
+			nm.exact[name[1:]] = true
+			nm.suffixes = append(nm.suffixes, namePattern{suffix: name})
+		case strings.ContainsAny(name, "*?["):
+			if _, err := path.Match(name, ""); err != nil {
+				return nil, fmt.Errorf("invalid name pattern %s: %s", raw, err)
+			}
+			nm.suffixes = append(nm.suffixes, namePattern{glob: name})
+		default:
+			nm.exact[name] = true
+		}
+	}
+	return nm, nil
+}
+
+func (nm NameMatcher) match(raw string) bool {
+	name := normalizeName(raw)
+	if name == "" {
+		return false
+	}
+	if nm.exact[name] {
+		return true
+	}
+	for _, p := range nm.suffixes {
+		if p.suffix != "" && strings.HasSuffix(name, p.suffix) {
+			return true
+		}
+		if p.glob != "" {
+			if ok, _ := path.Match(p.glob, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// ConditionDNS matches DNS query and answer names, including CNAME targets
+type ConditionDNS struct {
+	Names *NameMatcher
+}
+
+func (cd ConditionDNS) Match(pkt gopacket.Packet) bool {
+	dns := packetDNS(pkt)
+	if dns == nil {
+		return false
+	}
+	for _, q := range dns.Questions {
+		if cd.Names.match(string(q.Name)) {
+			return true
+		}
+	}
+	for _, rrs := range [][]layers.DNSResourceRecord{dns.Answers, dns.Authorities, dns.Additionals} {
+		for _, rr := range rrs {
+			if cd.Names.match(string(rr.Name)) || cd.Names.match(string(rr.CNAME)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// packetDNS returns decoded DNS layer, DNS over TCP is decoded manually due to length prefix
+func packetDNS(pkt gopacket.Packet) *layers.DNS {
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		if dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS); ok {
+			return dns
+		}
+		return nil
+	}
+	if tcp.SrcPort != 53 && tcp.DstPort != 53 || len(tcp.Payload) < 14 {
+		return nil
+	}
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(tcp.Payload[2:], gopacket.NilDecodeFeedback); err != nil {
+		return nil
+	}
+	return dns
+}
+
+// ConditionTLSSNI matches server name indication in TLS ClientHello
+type ConditionTLSSNI struct {
+	Names *NameMatcher
+}
+
+func (ct ConditionTLSSNI) Match(pkt gopacket.Packet) bool {
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	sni, ok := parseSNI(tcp.Payload)
+	return ok && ct.Names.match(sni)
+}
+
+/*
+parseSNI extracts server name from TLS ClientHello. Only ClientHello fully contained in first
+segment is handled, which is the case for nearly all clients.
+*/
+func parseSNI(data []byte) (string, bool) {
+	// record header, handshake header, client version and random
+	const helloStart = 5 + 4 + 2 + 32
+	if len(data) < helloStart+1 || data[0] != 0x16 || data[5] != 0x01 {
+		return "", false
+	}
+	pos := helloStart
+	// session id
+	pos += 1 + int(data[pos])
+	if pos+2 > len(data) {
+		return "", false
+	}
+	// cipher suites
+	pos += 2 + int(binary.BigEndian.Uint16(data[pos:]))
+	if pos+1 > len(data) {
+		return "", false
+	}
+	// compression methods
+	pos += 1 + int(data[pos])
+	if pos+2 > len(data) {
+		return "", false
+	}
+	end := pos + 2 + int(binary.BigEndian.Uint16(data[pos:]))
+	pos += 2
+	if end > len(data) {
+		end = len(data)
+	}
+	for pos+4 <= end {
+		extType := binary.BigEndian.Uint16(data[pos:])
+		extLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		pos += 4
+		if pos+extLen > end {
+			return "", false
+		}
+		if extType != 0 {
+			pos += extLen
+			continue
+		}
+		// server name list length, name type and name length
+		ext := data[pos : pos+extLen]
+		if len(ext) < 5 || ext[2] != 0 {
+			return "", false
+		}
+		nameLen := int(binary.BigEndian.Uint16(ext[3:]))
+		if 5+nameLen > len(ext) {
+			return "", false
+		}
+		return string(ext[5 : 5+nameLen]), true
+	}
+	return "", false
+}
+
+// ConditionHTTPHost matches Host header of HTTP requests
+type ConditionHTTPHost struct {
+	Names *NameMatcher
+}
+
+func (ch ConditionHTTPHost) Match(pkt gopacket.Packet) bool {
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	host, ok := parseHTTPHost(tcp.Payload)
+	return ok && ch.Names.match(host)
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+// parseHTTPHost extracts Host header value from HTTP request, port is stripped
+func parseHTTPHost(data []byte) (string, bool) {
+	var isRequest bool
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(data, m) {
+			isRequest = true
+			break
+		}
+	}
+	if !isRequest {
+		return "", false
+	}
+	if end := bytes.Index(data, []byte("\r\n\r\n")); end >= 0 {
+		data = data[:end]
+	}
+	lines := bytes.Split(data, []byte("\r\n"))
+	for _, line := range lines[1:] {
+		key, val, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !bytes.EqualFold(bytes.TrimSpace(key), []byte("host")) {
+			continue
+		}
+		host := string(bytes.TrimSpace(val))
+		if strings.HasPrefix(host, "[") {
+			// IPv6 literal
+			if end := strings.Index(host, "]"); end > 0 {
+				return host[1:end], true
+			}
+		} else if idx := strings.LastIndex(host, ":"); idx >= 0 {
+			host = host[:idx]
+		}
+		return host, host != ""
+	}
+	return "", false
+}
@@ -0,0 +1,94 @@
+package filter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+func TestNameMatcher(t *testing.T) {
+	nm, err := NewNameMatcher([]string{"evil.example.com", "*.bad.org", ".worse.net", "c2-*.example.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"EVIL.example.com.":      true,
+		"sub.evil.example.com":   false,
+		"bad.org":                false,
+		"x.bad.org":              true,
+		"worse.net":              true,
+		"a.b.worse.net":          true,
+		"notworse.net":           false,
+		"c2-1234.example.io":     true,
+		"www.c2-1234.example.io": false,
+	}
+	for name, want := range cases {
+		if got := nm.match(name); got != want {
+			t.Fatalf("%s: got %t, expected %t", name, got, want)
+		}
+	}
+}
+
+func TestParseSNI(t *testing.T) {
+	name := "evil.example.com"
+	sni := []byte{0x00, 0x00, 0x00, byte(len(name) + 5), 0x00, byte(len(name) + 3), 0x00, 0x00, byte(len(name))}
+	sni = append(sni, name...)
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...)
+	hello = append(hello, 0x00, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00)
+	hello = append(hello, 0x00, byte(len(sni)))
+	hello = append(hello, sni...)
+	data := []byte{0x16, 0x03, 0x01, 0x00, byte(len(hello) + 4), 0x01, 0x00, 0x00, byte(len(hello))}
+	data = append(data, hello...)
+
+	got, ok := parseSNI(data)
+	if !ok || got != name {
+		t.Fatalf("expected %s, got %q", name, got)
+	}
+	if _, ok := parseSNI(data[:len(data)-4]); ok {
+		t.Fatal("truncated hello should not parse")
+	}
+}
+
+func TestParseHTTPHost(t *testing.T) {
+	host, ok := parseHTTPHost([]byte("GET / HTTP/1.1\r\nUser-Agent: x\r\nhost: Evil.example.com:8080\r\n\r\n"))
+	if !ok || host != "Evil.example.com" {
+		t.Fatalf("unexpected host %q", host)
+	}
+	if _, ok := parseHTTPHost([]byte("HTTP/1.1 200 OK\r\nHost: a\r\n\r\n")); ok {
+		t.Fatal("responses should not be parsed")
+	}
+}
+
+func TestStickyMatcher(t *testing.T) {
+	ts := time.Unix(1600000000, 0)
+	pkt := func(src, dst net.IP, sport, dport uint16, offset time.Duration) gopacket.Packet {
+		p := buildPacketUDP(src, dst, sport, dport)
+		p.Metadata().Timestamp = ts.Add(offset)
+		return p
+	}
+	a, b := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	port, err := NewPortMatcher([]string{"4444/udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only first packet matches inner condition, rest of flow should follow
+	sm := StickyMatcher{M: DirectionMatcher{M: port, Direction: DirectionSrc}, Flows: NewFlowTable(time.Minute)}
+	if sm.Match(pkt(b, a, 5555, 4444, 0)) {
+		t.Fatal("flow not seen yet")
+	}
+	if !sm.Match(pkt(a, b, 4444, 5555, time.Second)) {
+		t.Fatal("inner condition should match")
+	}
+	if !sm.Match(pkt(b, a, 5555, 4444, 2*time.Second)) {
+		t.Fatal("reverse direction should match once flow is seen")
+	}
+	if sm.Match(pkt(b, a, 5555, 4444, -time.Second)) {
+		t.Fatal("packet before first match should not match")
+	}
+	if sm.Match(pkt(b, a, 5555, 4444, 5*time.Minute)) {
+		t.Fatal("flow should time out")
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// raw IP link types, not defined in gopacket
+const (
+	linkTypeIPv4 layers.LinkType = 228
+	linkTypeIPv6 layers.LinkType = 229
+)
+
+/*
+ConditionBPF matches packets against tcpdump filter expressions. Multiple expressions are
+combined with logical OR. Decapsulated packets do not begin with ethernet header, so each
+expression is also compiled for raw IPv4 and IPv6 link types and program is chosen by first
+layer of packet. Expressions are compiled once by libpcap and run in a Go BPF VM that keeps
+no state between runs, so a condition is safe for concurrent use.
+*/
+type ConditionBPF struct {
+	Expressions []string
+	programs    map[gopacket.LayerType][]*bpf.VM
+}
+
+func (cb ConditionBPF) Match(pkt gopacket.Packet) bool {
+	pktLayers := pkt.Layers()
+	if len(pktLayers) == 0 {
+		return false
+	}
+	programs, ok := cb.programs[pktLayers[0].LayerType()]
+	if !ok {
+		return false
+	}
+	data := pkt.Data()
+	for _, vm := range programs {
+		if n, err := vm.Run(data); err == nil && n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NewConditionBPF compiles tcpdump filter expressions into a Matcher
+func NewConditionBPF(expressions []string) (*ConditionBPF, error) {
+	if len(expressions) == 0 {
+		return nil, errors.New("no bpf expressions to compile")
+	}
+	cb := &ConditionBPF{
+		Expressions: expressions,
+		programs:    make(map[gopacket.LayerType][]*bpf.VM),
+	}
+	targets := []struct {
+		layer    gopacket.LayerType
+		linkType layers.LinkType
+	}{
+		{layer: layers.LayerTypeEthernet, linkType: layers.LinkTypeEthernet},
+		{layer: layers.LayerTypeIPv4, linkType: linkTypeIPv4},
+		{layer: layers.LayerTypeIPv6, linkType: linkTypeIPv6},
+	}
+	for _, expr := range expressions {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			return nil, errors.New("empty bpf expression")
+		}
+		var compiled int
+		var firstErr error
+		for _, t := range targets {
+			// link layer primitives such as ether host do not compile for raw IP
+			p, err := compileBPF(t.linkType, expr)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			cb.programs[t.layer] = append(cb.programs[t.layer], p)
+			compiled++
+		}
+		if compiled == 0 {
+			return nil, fmt.Errorf("bpf %s: %s", expr, firstErr)
+		}
+	}
+	return cb, nil
+}
+
+// compileBPF compiles expression with libpcap and loads resulting program into a Go BPF VM
+func compileBPF(linkType layers.LinkType, expr string) (*bpf.VM, error) {
+	instructions, err := pcap.CompileBPFFilter(linkType, 1024*64, expr)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return newBPFVM(raw)
+}
+
+func newBPFVM(raw []bpf.RawInstruction) (*bpf.VM, error) {
+	program, ok := bpf.Disassemble(raw)
+	if !ok {
+		return nil, errors.New("compiled bpf program uses unsupported instructions")
+	}
+	return bpf.NewVM(program)
+}
@@ -0,0 +1,150 @@
+package filter
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// programs below are what tcpdump -d prints for each expression on ethernet or raw IPv4
+var (
+	bpfSrcHost = []bpf.Instruction{
+		// ip src host 10.0.0.1
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 3},
+		bpf.LoadAbsolute{Off: 26, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0a000001, SkipFalse: 1},
+		bpf.RetConstant{Val: 262144},
+		bpf.RetConstant{Val: 0},
+	}
+	bpfDstHost = []bpf.Instruction{
+		// ip dst host 10.0.0.2
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 3},
+		bpf.LoadAbsolute{Off: 30, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0a000002, SkipFalse: 1},
+		bpf.RetConstant{Val: 262144},
+		bpf.RetConstant{Val: 0},
+	}
+	bpfVLAN = []bpf.Instruction{
+		// vlan 100
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x88a8, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x9100, SkipFalse: 4},
+		bpf.LoadAbsolute{Off: 14, Size: 2},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0fff},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 100, SkipFalse: 1},
+		bpf.RetConstant{Val: 262144},
+		bpf.RetConstant{Val: 0},
+	}
+	bpfRawDstPort = []bpf.Instruction{
+		// udp dst port 53 on raw IPv4
+		bpf.LoadAbsolute{Off: 9, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipFalse: 6},
+		bpf.LoadAbsolute{Off: 6, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Off: 2, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipFalse: 1},
+		bpf.RetConstant{Val: 262144},
+		bpf.RetConstant{Val: 0},
+	}
+)
+
+func newTestConditionBPF(t *testing.T, layer gopacket.LayerType, program []bpf.Instruction) *ConditionBPF {
+	t.Helper()
+	raw, err := bpf.Assemble(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := newBPFVM(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ConditionBPF{programs: map[gopacket.LayerType][]*bpf.VM{layer: {vm}}}
+}
+
+func TestConditionBPFPrograms(t *testing.T) {
+	forward := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1234, 53)
+	reverse := buildPacketUDP(net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 1}, 53, 1234)
+	raw := gopacket.NewPacket(forward.Data()[14:], layers.LayerTypeIPv4, gopacket.Default)
+	testCases := []struct {
+		desc    string
+		layer   gopacket.LayerType
+		program []bpf.Instruction
+		pkt     gopacket.Packet
+		match   bool
+	}{
+		{desc: "src host", layer: layers.LayerTypeEthernet, program: bpfSrcHost, pkt: forward, match: true},
+		{desc: "src host reverse", layer: layers.LayerTypeEthernet, program: bpfSrcHost, pkt: reverse},
+		{desc: "dst host", layer: layers.LayerTypeEthernet, program: bpfDstHost, pkt: forward, match: true},
+		{desc: "dst host reverse", layer: layers.LayerTypeEthernet, program: bpfDstHost, pkt: reverse},
+		{desc: "vlan", layer: layers.LayerTypeEthernet, program: bpfVLAN, pkt: buildPacketTagged(), match: true},
+		{desc: "vlan untagged", layer: layers.LayerTypeEthernet, program: bpfVLAN, pkt: forward},
+		{desc: "raw ip", layer: layers.LayerTypeIPv4, program: bpfRawDstPort, pkt: raw, match: true},
+		// program is chosen by first layer, ethernet packet has no raw IPv4 program
+		{desc: "raw ip on ethernet", layer: layers.LayerTypeIPv4, program: bpfRawDstPort, pkt: forward},
+	}
+	for _, tc := range testCases {
+		cb := newTestConditionBPF(t, tc.layer, tc.program)
+		if match := cb.Match(tc.pkt); match != tc.match {
+			t.Fatalf("%s: match %t, expected %t", tc.desc, match, tc.match)
+		}
+	}
+}
+
+func TestConditionBPFParallel(t *testing.T) {
+	cb := newTestConditionBPF(t, layers.LayerTypeEthernet, bpfSrcHost)
+	forward := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1234, 53)
+	reverse := buildPacketUDP(net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 1}, 53, 1234)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if !cb.Match(forward) || cb.Match(reverse) {
+					t.Error("concurrent match returned wrong result")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConditionBPFExpressions(t *testing.T) {
+	if _, err := NewConditionBPF([]string{"ip"}); err != nil {
+		t.Skipf("libpcap can not compile bpf: %s", err)
+	}
+	forward := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1234, 53)
+	tagged := buildPacketTagged()
+	testCases := []struct {
+		expr  string
+		pkt   gopacket.Packet
+		match bool
+	}{
+		{expr: "src host 10.0.0.1", pkt: forward, match: true},
+		{expr: "src host 10.0.0.2", pkt: forward},
+		{expr: "dst host 10.0.0.2 and dst port 53", pkt: forward, match: true},
+		{expr: "dst port 1234", pkt: forward},
+		{expr: "vlan 100", pkt: tagged, match: true},
+		{expr: "vlan 200", pkt: tagged},
+		{expr: "vlan 100 and vlan 200", pkt: tagged, match: true},
+		{expr: "vlan", pkt: forward},
+	}
+	for _, tc := range testCases {
+		cb, err := NewConditionBPF([]string{tc.expr})
+		if err != nil {
+			t.Fatalf("%s: %s", tc.expr, err)
+		}
+		if match := cb.Match(tc.pkt); match != tc.match {
+			t.Fatalf("%s: match %t, expected %t", tc.expr, match, tc.match)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CheckpointFile is default name of checkpoint file in filter output directory
+const CheckpointFile = ".checkpoint.jsonl"
+
+// CheckpointRecord marks a single input and filter pair as fully processed
+type CheckpointRecord struct {
+	Input     string          `json:"input"`
+	Filter    string          `json:"filter"`
+	Matched   int             `json:"matched"`
+	Outputs   []ManifestEntry `json:"outputs"`
+	Completed time.Time       `json:"completed"`
+}
+
+type checkpointKey struct {
+	input, filter string
+}
+
+/*
+Checkpoint records completed filter tasks so an interrupted run can be resumed. Records are
+appended as JSON lines and synced to disk one by one, so a crash can only lose the record that
+was being written. Tasks without a record are redone, overwriting partial outputs. Safe for
+concurrent use.
+*/
+type Checkpoint struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+	done map[checkpointKey]CheckpointRecord
+}
+
+/*
+OpenCheckpoint opens checkpoint file for appending. Existing records are loaded when resume
+is set, otherwise file is truncated. Missing file is not an error when resuming.
+*/
+func OpenCheckpoint(path string, resume bool) (*Checkpoint, error) {
+	cp := &Checkpoint{Path: path, done: make(map[checkpointKey]CheckpointRecord)}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		if err := cp.load(); err != nil {
+			return nil, err
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint open: %s", err)
+	}
+	cp.file = f
+	return cp, nil
+}
+
+func (cp *Checkpoint) load() error {
+	f, err := os.Open(cp.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("checkpoint load: %s", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec CheckpointRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// last record can be cut short by a crash, task is simply redone
+			continue
+		}
+		cp.done[checkpointKey{input: rec.Input, filter: rec.Filter}] = rec
+	}
+	return scanner.Err()
+}
+
+// Done returns record of completed task, if any
+func (cp *Checkpoint) Done(input, filter string) (CheckpointRecord, bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	rec, ok := cp.done[checkpointKey{input: input, filter: filter}]
+	return rec, ok
+}
+
+// Len returns number of completed tasks
+func (cp *Checkpoint) Len() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return len(cp.done)
+}
+
+// Add stores a completed task and syncs it to disk
+func (cp *Checkpoint) Add(rec CheckpointRecord) error {
+	if rec.Completed.IsZero() {
+		rec.Completed = time.Now()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if _, err := cp.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := cp.file.Sync(); err != nil {
+		return err
+	}
+	cp.done[checkpointKey{input: rec.Input, filter: rec.Filter}] = rec
+	return nil
+}
+
+// Close closes checkpoint file
+func (cp *Checkpoint) Close() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.file.Close()
+}
+
+// Remove closes and deletes checkpoint file, used once whole run has completed
+func (cp *Checkpoint) Remove() error {
+	if err := cp.Close(); err != nil {
+		return err
+	}
+	return os.Remove(cp.Path)
+}
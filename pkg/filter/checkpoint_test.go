@@ -0,0 +1,53 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CheckpointFile)
+	cp, err := OpenCheckpoint(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Add(CheckpointRecord{Input: "a.pcap", Filter: "web", Matched: 3}); err != nil {
+		t.Fatal(err)
+	}
+	cp.Close()
+
+	// simulate crash during second record
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"input":"b.pcap","filt`)
+	f.Close()
+
+	cp, err = OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, ok := cp.Done("a.pcap", "web"); !ok || rec.Matched != 3 {
+		t.Fatalf("completed task not loaded: %+v", rec)
+	}
+	if _, ok := cp.Done("a.pcap", "dns"); ok {
+		t.Fatal("unexpected completed task")
+	}
+	if cp.Len() != 1 {
+		t.Fatalf("expected 1 completed task, got %d", cp.Len())
+	}
+	cp.Close()
+
+	cp, err = OpenCheckpoint(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Len() != 0 {
+		t.Fatal("checkpoint should start empty without resume")
+	}
+	if err := cp.Remove(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -37,6 +38,23 @@ const (
 	FilterKindPort
 	FilterKindASN
 	FilterKindRaw
+	FilterKindBPF
+	FilterKindFlow
+	FilterKindProto
+	FilterKindICMP
+	FilterKindICMPv6
+	FilterKindTCPFlags
+	FilterKindVLAN
+	FilterKindMPLS
+	FilterKindCountry
+	FilterKindContinent
+	FilterKindCity
+	FilterKindIPList
+	FilterKindContent
+	FilterKindPCRE
+	FilterKindDNS
+	FilterKindTLSSNI
+	FilterKindHTTPHost
 )
 
 func (k FilterKind) String() string {
@@ -51,6 +69,40 @@ func (k FilterKind) String() string {
 		return "asn"
 	case FilterKindRaw:
 		return "raw"
+	case FilterKindBPF:
+		return "bpf"
+	case FilterKindFlow:
+		return "flow"
+	case FilterKindProto:
+		return "proto"
+	case FilterKindICMP:
+		return "icmp"
+	case FilterKindICMPv6:
+		return "icmp6"
+	case FilterKindTCPFlags:
+		return "tcp-flags"
+	case FilterKindVLAN:
+		return "vlan"
+	case FilterKindMPLS:
+		return "mpls"
+	case FilterKindCountry:
+		return "country"
+	case FilterKindContinent:
+		return "continent"
+	case FilterKindCity:
+		return "city"
+	case FilterKindIPList:
+		return "iplist"
+	case FilterKindContent:
+		return "content"
+	case FilterKindPCRE:
+		return "pcre"
+	case FilterKindDNS:
+		return "dns"
+	case FilterKindTLSSNI:
+		return "tls-sni"
+	case FilterKindHTTPHost:
+		return "http-host"
 	default:
 		return "undefined"
 	}
@@ -62,6 +114,23 @@ var FilterKinds = []string{
 	FilterKindPort.String(),
 	FilterKindASN.String(),
 	FilterKindRaw.String(),
+	FilterKindBPF.String(),
+	FilterKindFlow.String(),
+	FilterKindProto.String(),
+	FilterKindICMP.String(),
+	FilterKindICMPv6.String(),
+	FilterKindTCPFlags.String(),
+	FilterKindVLAN.String(),
+	FilterKindMPLS.String(),
+	FilterKindCountry.String(),
+	FilterKindContinent.String(),
+	FilterKindCity.String(),
+	FilterKindIPList.String(),
+	FilterKindContent.String(),
+	FilterKindPCRE.String(),
+	FilterKindDNS.String(),
+	FilterKindTLSSNI.String(),
+	FilterKindHTTPHost.String(),
 }
 
 func NewFilterKind(raw string) FilterKind {
@@ -76,6 +145,40 @@ func NewFilterKind(raw string) FilterKind {
 		return FilterKindASN
 	case FilterKindRaw.String():
 		return FilterKindRaw
+	case FilterKindBPF.String():
+		return FilterKindBPF
+	case FilterKindFlow.String():
+		return FilterKindFlow
+	case FilterKindProto.String():
+		return FilterKindProto
+	case FilterKindICMP.String():
+		return FilterKindICMP
+	case FilterKindICMPv6.String():
+		return FilterKindICMPv6
+	case FilterKindTCPFlags.String():
+		return FilterKindTCPFlags
+	case FilterKindVLAN.String():
+		return FilterKindVLAN
+	case FilterKindMPLS.String():
+		return FilterKindMPLS
+	case FilterKindCountry.String():
+		return FilterKindCountry
+	case FilterKindContinent.String():
+		return FilterKindContinent
+	case FilterKindCity.String():
+		return FilterKindCity
+	case FilterKindIPList.String():
+		return FilterKindIPList
+	case FilterKindContent.String():
+		return FilterKindContent
+	case FilterKindPCRE.String():
+		return FilterKindPCRE
+	case FilterKindDNS.String():
+		return FilterKindDNS
+	case FilterKindTLSSNI.String():
+		return FilterKindTLSSNI
+	case FilterKindHTTPHost.String():
+		return FilterKindHTTPHost
 	default:
 		return FilterKindUndefined
 	}
@@ -107,60 +210,215 @@ func (cm CombinedMatcher) Match(pkt gopacket.Packet) bool {
 	return true
 }
 
+func (cm CombinedMatcher) withFreshFlows() (Matcher, bool) {
+	conditions, ok := flowScopeAll(cm.Conditions)
+	return CombinedMatcher{Conditions: conditions}, ok
+}
+
 func NewCombinedMatcher(c MatcherConfig) (*CombinedMatcher, error) {
 	if len(c.Conditions) == 0 {
 		return nil, errors.New("combined config condition missing")
 	}
-	conditions := make([]Matcher, 0, len(c.Conditions))
-	for i, condition := range c.Conditions {
-		var m Matcher
-		switch NewFilterKind(condition.Kind) {
-		case FilterKindSubnet:
-			sm, err := NewConditionalSubnet(condition.Match)
-			if err != nil {
-				return nil, err
-			}
-			m = sm
-		case FilterKindEther:
-			sm, err := NewConditionEther(condition.Match)
-			if err != nil {
-				return nil, err
-			}
-			m = sm
-		case FilterKindPort:
-			pm, err := NewPortMatcher(condition.Match)
-			if err != nil {
-				return nil, err
-			}
-			m = pm
-		case FilterKindASN:
-			if c.MaxMindASN == "" {
-				return nil, errors.New("asn matcher needs maxmind ASN database")
-			}
-			fa, err := NewConditionASN(c.MaxMindASN, condition.Match)
+	conditions, err := c.newMatchers(c.Conditions, "conditions")
+	if err != nil {
+		return nil, err
+	}
+	return &CombinedMatcher{
+		Conditions: conditions,
+	}, nil
+}
+
+func (c MatcherConfig) newMatchers(items []FilterItem, path string) ([]Matcher, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%s: empty condition group", path)
+	}
+	tx := make([]Matcher, 0, len(items))
+	for i, item := range items {
+		m, err := c.newMatcher(item, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		tx = append(tx, m)
+	}
+	return tx, nil
+}
+
+// newMatcher recursively builds a matcher tree for a single condition item
+func (c MatcherConfig) newMatcher(item FilterItem, path string) (Matcher, error) {
+	var defined int
+	for _, set := range []bool{item.Kind != "", item.Any != nil, item.All != nil, item.Not != nil} {
+		if set {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return nil, fmt.Errorf("%s: condition must define exactly one of kind, any, all or not", path)
+	}
+	isFlow := NewFilterKind(item.Kind) == FilterKindFlow
+	if !isFlow && (item.Src != nil || item.Dst != nil || item.Oneway) {
+		return nil, fmt.Errorf("%s: src, dst and oneway are only valid for %s kind", path, FilterKindFlow)
+	}
+	if item.Direction != "" && item.Kind == "" {
+		return nil, fmt.Errorf("%s: direction is not supported for condition groups", path)
+	}
+
+	var m Matcher
+	switch {
+	case item.Any != nil:
+		items, err := c.newMatchers(item.Any, path+".any")
+		if err != nil {
+			return nil, err
+		}
+		m = AnyMatcher{Conditions: items}
+	case item.All != nil:
+		items, err := c.newMatchers(item.All, path+".all")
+		if err != nil {
+			return nil, err
+		}
+		m = CombinedMatcher{Conditions: items}
+	case item.Not != nil:
+		inner, err := c.newMatcher(*item.Not, path+".not")
+		if err != nil {
+			return nil, err
+		}
+		m = NegateMatcher{M: inner}
+	case isFlow:
+		fm, err := c.newFlowMatcher(item, path)
+		if err != nil {
+			return nil, err
+		}
+		m = fm
+	default:
+		leaf, err := c.newLeafMatcher(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		m = leaf
+		if item.Direction != "" {
+			dm, err := NewDirectionMatcher(leaf, item.Direction)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%s: %s", path, err)
 			}
-			m = fa
-		case FilterKindRaw:
-			m = &DummyMatcher{}
-		default:
-			return nil, fmt.Errorf(
-				"filtering condition %s unsupported for condition %d, use one of %s",
-				condition.Kind, i, strings.Join(FilterKinds, ", "),
-			)
+			m = dm
+		}
+	}
+	if m == nil {
+		return nil, fmt.Errorf("%s: unable to build matcher", path)
+	}
+	if item.Sticky {
+		m = StickyMatcher{M: m, Flows: NewFlowTable(c.FlowTimeout)}
+	}
+	if item.Negate {
+		m = NegateMatcher{M: m}
+	}
+	if c.Hits != nil {
+		m = c.Hits.wrap(m, item, path)
+	}
+	return m, nil
+}
+
+func (c MatcherConfig) newLeafMatcher(condition FilterItem) (Matcher, error) {
+	switch NewFilterKind(condition.Kind) {
+	case FilterKindSubnet:
+		return NewConditionalSubnet(condition.Match)
+	case FilterKindEther:
+		return NewConditionEther(condition.Match)
+	case FilterKindPort:
+		return NewPortMatcher(condition.Match)
+	case FilterKindASN:
+		if c.MaxMindASN == "" {
+			return nil, errors.New("asn matcher needs maxmind ASN database")
+		}
+		asn, err := NewConditionASN(c.MaxMindASN, condition.Match)
+		if err == nil && c.Hits != nil {
+			c.Hits.addASN(asn)
 		}
-		if m == nil {
-			return nil, fmt.Errorf("unable to build matcher for item %d", i)
+		return asn, err
+	case FilterKindRaw:
+		// raw without expressions is kept as match-all for backwards compatibility
+		if len(condition.Match) == 0 {
+			return &DummyMatcher{}, nil
 		}
-		if condition.Negate {
-			m = NegateMatcher{M: m}
+		return NewConditionBPF(condition.Match)
+	case FilterKindBPF:
+		return NewConditionBPF(condition.Match)
+	case FilterKindProto:
+		return NewConditionProto(condition.Match)
+	case FilterKindICMP:
+		return NewConditionICMP(condition.Match, false)
+	case FilterKindICMPv6:
+		return NewConditionICMP(condition.Match, true)
+	case FilterKindTCPFlags:
+		return NewConditionTCPFlags(condition.Match)
+	case FilterKindVLAN:
+		return NewConditionTag(condition.Match, layers.LayerTypeDot1Q)
+	case FilterKindMPLS:
+		return NewConditionTag(condition.Match, layers.LayerTypeMPLS)
+	case FilterKindCountry, FilterKindContinent:
+		// city database also holds country info
+		path := c.MaxMindCountry
+		if path == "" {
+			path = c.MaxMindCity
 		}
-		conditions = append(conditions, m)
+		return c.newConditionGeo(path, NewFilterKind(condition.Kind), condition.Match)
+	case FilterKindCity:
+		return c.newConditionGeo(c.MaxMindCity, FilterKindCity, condition.Match)
+	case FilterKindIPList:
+		return NewConditionIPList(condition.Match)
+	case FilterKindContent:
+		return NewConditionContent(condition.Match)
+	case FilterKindPCRE:
+		return NewConditionPCRE(condition.Match)
+	case FilterKindDNS, FilterKindTLSSNI, FilterKindHTTPHost:
+		names, err := NewNameMatcher(condition.Match)
+		if err != nil {
+			return nil, err
+		}
+		switch NewFilterKind(condition.Kind) {
+		case FilterKindDNS:
+			return &ConditionDNS{Names: names}, nil
+		case FilterKindTLSSNI:
+			return &ConditionTLSSNI{Names: names}, nil
+		default:
+			return &ConditionHTTPHost{Names: names}, nil
+		}
+	default:
+		return nil, fmt.Errorf(
+			"filtering condition %s unsupported, use one of %s",
+			condition.Kind, strings.Join(FilterKinds, ", "),
+		)
 	}
-	return &CombinedMatcher{
-		Conditions: conditions,
-	}, nil
+}
+
+// newConditionGeo builds geo condition and registers it for lookup error counts
+func (c MatcherConfig) newConditionGeo(path string, kind FilterKind, values []string) (Matcher, error) {
+	cg, err := NewConditionGeo(path, kind, values)
+	if err != nil {
+		return nil, err
+	}
+	if c.Hits != nil {
+		c.Hits.addGeo(cg)
+	}
+	return cg, nil
+}
+
+// AnyMatcher implements logical OR
+type AnyMatcher struct {
+	Conditions []Matcher
+}
+
+func (am AnyMatcher) Match(pkt gopacket.Packet) bool {
+	for _, matcher := range am.Conditions {
+		if matcher.Match(pkt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (am AnyMatcher) withFreshFlows() (Matcher, bool) {
+	conditions, ok := flowScopeAll(am.Conditions)
+	return AnyMatcher{Conditions: conditions}, ok
 }
 
 // NegateMatcher implements logical NOT
@@ -170,6 +428,11 @@ type NegateMatcher struct {
 
 func (nm NegateMatcher) Match(pkt gopacket.Packet) bool { return !nm.M.Match(pkt) }
 
+func (nm NegateMatcher) withFreshFlows() (Matcher, bool) {
+	inner, ok := flowScope(nm.M)
+	return NegateMatcher{M: inner}, ok
+}
+
 // NewConditionalSubnet parses a list of textual network addrs into a Matcher
 func NewConditionalSubnet(nets []string) (ConditionSubnet, error) {
 	if len(nets) == 0 {
@@ -189,11 +452,16 @@ func NewConditionalSubnet(nets []string) (ConditionSubnet, error) {
 type ConditionSubnet []net.IPNet
 
 func (cs ConditionSubnet) Match(pkt gopacket.Packet) bool {
+	src, dst := cs.MatchSides(pkt)
+	return src || dst
+}
+
+func (cs ConditionSubnet) MatchSides(pkt gopacket.Packet) (bool, bool) {
 	if n := pkt.NetworkLayer(); n != nil {
-		return cs.match(net.ParseIP(n.NetworkFlow().Src().String())) ||
+		return cs.match(net.ParseIP(n.NetworkFlow().Src().String())),
 			cs.match(net.ParseIP(n.NetworkFlow().Dst().String()))
 	}
-	return false
+	return false, false
 }
 
 func (cs ConditionSubnet) match(ip net.IP) bool {
@@ -211,60 +479,164 @@ func (cs ConditionSubnet) match(ip net.IP) bool {
 type ConditionEther map[string]bool
 
 func (cs ConditionEther) Match(pkt gopacket.Packet) bool {
-	fmt.Println(pkt.LinkLayer().LinkFlow().Src().String())
+	src, dst := cs.MatchSides(pkt)
+	return src || dst
+}
+
+func (cs ConditionEther) MatchSides(pkt gopacket.Packet) (bool, bool) {
 	if n := pkt.LinkLayer(); n != nil {
-		return cs[n.LinkFlow().Src().String()] || cs[n.LinkFlow().Dst().String()]
+		return cs[n.LinkFlow().Src().String()], cs[n.LinkFlow().Dst().String()]
 	}
-	return false
+	return false, false
 }
 
 func NewConditionEther(e []string) (ConditionEther, error) {
 	ce := make(ConditionEther)
 	for _, mac := range e {
-		_, err := net.ParseMAC(mac)
+		parsed, err := net.ParseMAC(mac)
 		if err != nil {
 			return ce, fmt.Errorf("invalid MAC %s", mac)
 		}
-		ce[mac] = true
+		// link flow endpoints are formatted in lowercase colon notation
+		ce[parsed.String()] = true
 	}
 	return ce, nil
 }
 
-func NewPortMatcher(p []string) (ConditionEndpoint, error) {
-	vals := make(map[gopacket.Endpoint]bool)
+/*
+NewPortMatcher parses a list of textual port definitions into a Matcher. Supported formats are
+<port>, <port>/<proto>, <low>-<high> and <low>-<high>/<proto> where proto is tcp, udp or sctp.
+Port without protocol matches all of them.
+*/
+func NewPortMatcher(p []string) (*ConditionPort, error) {
+	if len(p) == 0 {
+		return nil, errors.New("no ports to parse into condition")
+	}
+	cp := &ConditionPort{
+		Endpoints: make(ConditionEndpoint),
+		Ranges:    make([]portRange, 0),
+	}
 	for _, raw := range p {
 		bits := strings.Split(raw, "/")
-		if len(bits) != 2 {
-			return nil, fmt.Errorf("%s not valid port format, should be <number>/<tcp/udp>", raw)
+		if len(bits) > 2 {
+			return nil, fmt.Errorf(
+				"%s not valid port format, should be <number>[-<number>][/<tcp|udp|sctp>]", raw)
 		}
-		port, err := strconv.Atoi(bits[0])
+		var endpointTypes []gopacket.EndpointType
+		if len(bits) == 2 {
+			et, err := portEndpointType(bits[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", raw, err)
+			}
+			endpointTypes = []gopacket.EndpointType{et}
+		} else {
+			endpointTypes = []gopacket.EndpointType{
+				layers.EndpointTCPPort,
+				layers.EndpointUDPPort,
+				layers.EndpointSCTPPort,
+			}
+		}
+		low, high, err := parsePortRange(bits[0])
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %s", raw, err)
 		}
-		switch bits[1] {
-		case "tcp":
-			vals[layers.NewTCPPortEndpoint(layers.TCPPort(port))] = true
-		case "udp":
-			vals[layers.NewUDPPortEndpoint(layers.UDPPort(port))] = true
-		default:
-			return nil, fmt.Errorf(
-				"protocol def invalid for %s, got %s, expected tcp or udp",
-				raw,
-				bits[1],
-			)
+		for _, et := range endpointTypes {
+			if low == high {
+				cp.Endpoints[gopacket.NewEndpoint(et, []byte{byte(low >> 8), byte(low)})] = true
+			} else {
+				cp.Ranges = append(cp.Ranges, portRange{endpointType: et, low: low, high: high})
+			}
+		}
+	}
+	return cp, nil
+}
+
+func portEndpointType(proto string) (gopacket.EndpointType, error) {
+	switch proto {
+	case "tcp":
+		return layers.EndpointTCPPort, nil
+	case "udp":
+		return layers.EndpointUDPPort, nil
+	case "sctp":
+		return layers.EndpointSCTPPort, nil
+	default:
+		return 0, fmt.Errorf("protocol def invalid, got %s, expected tcp, udp or sctp", proto)
+	}
+}
+
+func parsePortRange(raw string) (uint16, uint16, error) {
+	bits := strings.SplitN(raw, "-", 2)
+	low, err := strconv.ParseUint(bits[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	high := low
+	if len(bits) == 2 {
+		high, err = strconv.ParseUint(bits[1], 10, 16)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if high < low {
+		return 0, 0, fmt.Errorf("port range %d-%d is reversed", low, high)
+	}
+	return uint16(low), uint16(high), nil
+}
+
+type portRange struct {
+	endpointType gopacket.EndpointType
+	low, high    uint16
+}
+
+// ConditionPort matches exact transport endpoints and port ranges
+type ConditionPort struct {
+	Endpoints ConditionEndpoint
+	Ranges    []portRange
+}
+
+func (cp ConditionPort) Match(pkt gopacket.Packet) bool {
+	src, dst := cp.MatchSides(pkt)
+	return src || dst
+}
+
+func (cp ConditionPort) MatchSides(pkt gopacket.Packet) (bool, bool) {
+	if t := pkt.TransportLayer(); t != nil {
+		tf := t.TransportFlow()
+		return cp.match(tf.Src()), cp.match(tf.Dst())
+	}
+	return false, false
+}
+
+func (cp ConditionPort) match(v gopacket.Endpoint) bool {
+	if cp.Endpoints[v] {
+		return true
+	}
+	raw := v.Raw()
+	if len(raw) != 2 {
+		return false
+	}
+	port := uint16(raw[0])<<8 | uint16(raw[1])
+	for _, r := range cp.Ranges {
+		if r.endpointType == v.EndpointType() && port >= r.low && port <= r.high {
+			return true
 		}
 	}
-	return vals, nil
+	return false
 }
 
 type ConditionEndpoint map[gopacket.Endpoint]bool
 
 func (cs ConditionEndpoint) Match(pkt gopacket.Packet) bool {
+	src, dst := cs.MatchSides(pkt)
+	return src || dst
+}
+
+func (cs ConditionEndpoint) MatchSides(pkt gopacket.Packet) (bool, bool) {
 	if t := pkt.TransportLayer(); t != nil {
 		tf := t.TransportFlow()
-		return cs.match(tf.Src()) || cs.match(tf.Dst())
+		return cs.match(tf.Src()), cs.match(tf.Dst())
 	}
-	return false
+	return false, false
 }
 
 func (cs ConditionEndpoint) match(v gopacket.Endpoint) bool {
@@ -276,31 +648,50 @@ type ConditionASN struct {
 	DB          *geoip2.Reader
 	LookupErrs  int
 	IPParseErrs int
+
+	// condition is shared by workers, so error counters need a lock
+	mu sync.Mutex
 }
 
-func (ca ConditionASN) Match(pkt gopacket.Packet) bool {
+func (ca *ConditionASN) Match(pkt gopacket.Packet) bool {
+	src, dst := ca.MatchSides(pkt)
+	return src || dst
+}
+
+func (ca *ConditionASN) MatchSides(pkt gopacket.Packet) (bool, bool) {
 	if n := pkt.NetworkLayer(); n != nil {
-		return ca.match(net.ParseIP(n.NetworkFlow().Src().String())) ||
+		return ca.match(net.ParseIP(n.NetworkFlow().Src().String())),
 			ca.match(net.ParseIP(n.NetworkFlow().Dst().String()))
 	}
-	return false
+	return false, false
 }
 
 func (ca *ConditionASN) match(ip net.IP) bool {
 	if ip == nil {
+		ca.mu.Lock()
 		ca.IPParseErrs++
+		ca.mu.Unlock()
 		return false
 	}
 	resp, err := ca.DB.ASN(ip)
 	if err != nil {
+		ca.mu.Lock()
 		ca.LookupErrs++
+		ca.mu.Unlock()
 		return false
 	}
 	return ca.Values[resp.AutonomousSystemNumber]
 }
 
+// Errs returns lookup and IP parse error counts
+func (ca *ConditionASN) Errs() (int, int) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.LookupErrs, ca.IPParseErrs
+}
+
 func NewConditionASN(path string, asn []string) (*ConditionASN, error) {
-	db, err := geoip2.Open(path)
+	db, err := openGeoDB(path)
 	if err != nil {
 		return nil, err
 	}
@@ -313,7 +704,7 @@ func NewConditionASN(path string, asn []string) (*ConditionASN, error) {
 		conditions[uint(parsed)] = true
 	}
 	return &ConditionASN{
-		DB:     db,
+		DB:     db.Reader,
 		Values: conditions,
 	}, nil
 }
@@ -0,0 +1,223 @@
+package filter
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"gopkg.in/yaml.v2"
+)
+
+func buildPacketUDP(src, dst net.IP, sport, dport uint16) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0xFF, 0xAA, 0xFA, 0xAA, 0xFF, 0xAA},
+		DstMAC:       net.HardwareAddr{0xBD, 0xBD, 0xBD, 0xBD, 0xBD, 0xAA},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    src,
+		DstIP:    dst,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}, eth, ip, udp, gopacket.Payload([]byte{1, 2, 3})); err != nil {
+		panic(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func newTestMatcher(t *testing.T, raw string) (*CombinedMatcher, error) {
+	t.Helper()
+	var cfg CombinedConfig
+	if err := yaml.Unmarshal([]byte(raw), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return NewCombinedMatcher(MatcherConfig{CombinedConfig: cfg})
+}
+
+func TestBooleanTree(t *testing.T) {
+	m, err := newTestMatcher(t, `
+conditions:
+  - any:
+      - kind: subnet
+        match: [10.0.0.0/8]
+      - all:
+          - kind: port
+            match: [53/udp]
+          - not:
+              kind: subnet
+              match: [192.168.0.0/16]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		pkt  gopacket.Packet
+		want bool
+		desc string
+	}{
+		{buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{8, 8, 8, 8}, 1234, 80), true, "subnet branch"},
+		{buildPacketUDP(net.IP{172, 16, 0, 1}, net.IP{8, 8, 8, 8}, 1234, 53), true, "port branch"},
+		{buildPacketUDP(net.IP{192, 168, 0, 1}, net.IP{8, 8, 8, 8}, 1234, 53), false, "negated subnet"},
+		{buildPacketUDP(net.IP{172, 16, 0, 1}, net.IP{8, 8, 8, 8}, 1234, 80), false, "no branch"},
+	}
+	for _, c := range cases {
+		if got := m.Match(c.pkt); got != c.want {
+			t.Fatalf("%s: got %t, expected %t", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestBooleanTreeErrorPath(t *testing.T) {
+	cases := []struct {
+		raw  string
+		path string
+	}{
+		{`
+conditions:
+  - kind: subnet
+    match: [10.0.0.0/8]
+  - any:
+      - kind: port
+        match: [53/udp]
+      - kind: subnet
+        match: [not-a-net]
+`, "conditions[1].any[1]:"},
+		{`
+conditions:
+  - not:
+      all: []
+`, "conditions[0].not.all:"},
+		{`
+conditions:
+  - kind: subnet
+    match: [10.0.0.0/8]
+    any:
+      - kind: port
+        match: [53/udp]
+`, "conditions[0]:"},
+	}
+	for _, c := range cases {
+		_, err := newTestMatcher(t, c.raw)
+		if err == nil {
+			t.Fatalf("expected error for %s", c.path)
+		}
+		if !strings.HasPrefix(err.Error(), c.path) {
+			t.Fatalf("error %q does not point at %s", err, c.path)
+		}
+	}
+}
+
+func TestDirectionAndFlow(t *testing.T) {
+	out := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{8, 8, 8, 8}, 1234, 53)
+	in := buildPacketUDP(net.IP{8, 8, 8, 8}, net.IP{10, 0, 0, 1}, 53, 1234)
+	other := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{1, 1, 1, 1}, 1234, 53)
+	arp := arpAt(net.HardwareAddr{2, 0, 0, 0, 0, 1}, time.Time{})
+
+	cases := []struct {
+		raw  string
+		want []bool
+		desc string
+	}{
+		{`
+conditions:
+  - kind: subnet
+    match: [10.0.0.0/8]
+    direction: src
+`, []bool{true, false, true, false}, "src direction"},
+		{`
+conditions:
+  - kind: port
+    match: [53/udp]
+    direction: dst
+`, []bool{true, false, true, false}, "dst direction"},
+		{`
+conditions:
+  - kind: flow
+    src:
+      kind: subnet
+      match: [10.0.0.0/8]
+    dst:
+      kind: subnet
+      match: [8.8.8.8/32]
+`, []bool{true, true, false, false}, "bidirectional flow"},
+		{`
+conditions:
+  - kind: flow
+    oneway: true
+    src:
+      kind: subnet
+      match: [10.0.0.0/8]
+    dst:
+      kind: subnet
+      match: [8.8.8.8/32]
+`, []bool{true, false, false, false}, "oneway flow"},
+		{`
+conditions:
+  - kind: flow
+    oneway: true
+    src:
+      kind: subnet
+      match: [8.8.8.8/32]
+      negate: true
+    dst:
+      kind: subnet
+      match: [1.1.1.1/32]
+      negate: true
+`, []bool{true, false, false, false}, "negated flow endpoints"},
+	}
+	for _, c := range cases {
+		m, err := newTestMatcher(t, c.raw)
+		if err != nil {
+			t.Fatalf("%s: %s", c.desc, err)
+		}
+		for i, pkt := range []gopacket.Packet{out, in, other, arp} {
+			if got := m.Match(pkt); got != c.want[i] {
+				t.Fatalf("%s: packet %d got %t, expected %t", c.desc, i, got, c.want[i])
+			}
+		}
+	}
+}
+
+func TestPortAndProto(t *testing.T) {
+	pkt := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{8, 8, 8, 8}, 40000, 53)
+	cases := []struct {
+		kind  string
+		match []string
+		want  bool
+	}{
+		{"port", []string{"53"}, true},
+		{"port", []string{"53/tcp"}, false},
+		{"port", []string{"1024-65535/udp"}, true},
+		{"port", []string{"1024-30000"}, false},
+		{"proto", []string{"udp"}, true},
+		{"proto", []string{"6"}, false},
+		{"tcp-flags", []string{"syn,!ack"}, false},
+	}
+	for _, c := range cases {
+		m, err := NewCombinedMatcher(MatcherConfig{CombinedConfig: CombinedConfig{
+			Conditions: []FilterItem{{Kind: c.kind, Match: c.match}},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(pkt); got != c.want {
+			t.Fatalf("%s %v: got %t, expected %t", c.kind, c.match, got, c.want)
+		}
+	}
+	for _, bad := range []string{"70000", "2000-1000/tcp", "53/icmp"} {
+		if _, err := NewPortMatcher([]string{bad}); err == nil {
+			t.Fatalf("expected error for port %s", bad)
+		}
+	}
+}
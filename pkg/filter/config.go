@@ -16,19 +16,48 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 */
 package filter
 
+import "time"
+
 type YAMLConfig map[string]CombinedConfig
 
 type CombinedConfig struct {
 	Conditions []FilterItem `yaml:"conditions,omitempty"`
 }
 
+/*
+FilterItem is either a single condition defined by Kind and Match, or a group of nested
+conditions. Exactly one of Kind, Any, All or Not must be set.
+*/
 type FilterItem struct {
 	Kind   string   `yaml:"kind,omitempty"`
 	Negate bool     `yaml:"negate,omitempty"`
 	Match  []string `yaml:"match,omitempty"`
+	// Direction limits condition to source or destination side of packet, see Direction
+	Direction string `yaml:"direction,omitempty"`
+	// Sticky extends match to all following packets of same flow in same input file
+	Sticky bool `yaml:"sticky,omitempty"`
+
+	// Any matches if at least one nested condition matches
+	Any []FilterItem `yaml:"any,omitempty"`
+	// All matches if every nested condition matches
+	All []FilterItem `yaml:"all,omitempty"`
+	// Not inverts nested condition
+	Not *FilterItem `yaml:"not,omitempty"`
+
+	// Src and Dst define endpoint conditions for flow kind
+	Src *FilterItem `yaml:"src,omitempty"`
+	Dst *FilterItem `yaml:"dst,omitempty"`
+	// Oneway disables matching flow kind in reverse direction
+	Oneway bool `yaml:"oneway,omitempty"`
 }
 
 type MatcherConfig struct {
-  CombinedConfig
-  MaxMindASN string
+	CombinedConfig
+	MaxMindASN     string
+	MaxMindCountry string
+	MaxMindCity    string
+	// FlowTimeout is idle timeout for sticky conditions
+	FlowTimeout time.Duration
+	// Hits collects per condition hit counts when set
+	Hits *ConditionHits
 }
@@ -0,0 +1,325 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+)
+
+// payload returns transport layer payload, or network payload for protocols such as ICMP
+func payload(pkt gopacket.Packet) []byte {
+	if t := pkt.TransportLayer(); t != nil {
+		return t.LayerPayload()
+	}
+	if n := pkt.NetworkLayer(); n != nil {
+		return n.LayerPayload()
+	}
+	return nil
+}
+
+type contentPattern struct {
+	raw     string
+	pattern []byte
+	offset  int
+	depth   int
+	nocase  bool
+}
+
+func (cp contentPattern) match(data []byte) bool {
+	if cp.offset >= len(data) {
+		return false
+	}
+	window := data[cp.offset:]
+	if cp.depth > 0 && cp.depth < len(window) {
+		window = window[:cp.depth]
+	}
+	if cp.nocase {
+		return bytes.Contains(lowerASCII(window), cp.pattern)
+	}
+	return bytes.Contains(window, cp.pattern)
+}
+
+/*
+parseContent parses a Suricata style content definition. Binary data is written as hex
+between pipes, such as "GET |20|/admin". Trailing modifiers are separated by semicolons,
+supported ones are offset:<n>, depth:<n> and nocase. Use |3b| for a literal semicolon.
+*/
+func parseContent(raw string) (*contentPattern, error) {
+	cp := &contentPattern{raw: raw}
+	bits := strings.Split(raw, ";")
+	value := bits[0]
+	for _, mod := range bits[1:] {
+		mod = strings.TrimSpace(mod)
+		key, val, hasVal := strings.Cut(mod, ":")
+		switch {
+		case mod == "nocase":
+			cp.nocase = true
+		case hasVal && (key == "offset" || key == "depth"):
+			n, err := strconv.Atoi(strings.TrimSpace(val))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s value %s", key, val)
+			}
+			if key == "offset" {
+				cp.offset = n
+			} else {
+				cp.depth = n
+			}
+		case mod == "":
+		default:
+			return nil, fmt.Errorf("unknown content modifier %s", mod)
+		}
+	}
+
+	var buf bytes.Buffer
+	for i, segment := range strings.Split(value, "|") {
+		if i%2 == 0 {
+			buf.WriteString(segment)
+			continue
+		}
+		decoded, err := hex.DecodeString(strings.ReplaceAll(segment, " ", ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex in content: %s", err)
+		}
+		buf.Write(decoded)
+	}
+	if strings.Count(value, "|")%2 != 0 {
+		return nil, errors.New("unterminated hex segment in content")
+	}
+	if buf.Len() == 0 {
+		return nil, errors.New("empty content")
+	}
+	cp.pattern = buf.Bytes()
+	if cp.nocase {
+		cp.pattern = lowerASCII(cp.pattern)
+	}
+	return cp, nil
+}
+
+/*
+ConditionContent matches packets with payload containing any of defined byte patterns.
+Patterns without offset or depth are searched in a single pass with Aho-Corasick automaton,
+so large pattern sets do not slow down matching.
+*/
+type ConditionContent struct {
+	anywhere       *ahoCorasick
+	anywhereNocase *ahoCorasick
+	windowed       []*contentPattern
+}
+
+func (cc ConditionContent) Match(pkt gopacket.Packet) bool {
+	data := payload(pkt)
+	if len(data) == 0 {
+		return false
+	}
+	if cc.anywhere != nil && cc.anywhere.match(data) {
+		return true
+	}
+	if cc.anywhereNocase != nil && cc.anywhereNocase.match(data) {
+		return true
+	}
+	for _, cp := range cc.windowed {
+		if cp.match(data) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewConditionContent(values []string) (*ConditionContent, error) {
+	if len(values) == 0 {
+		return nil, errors.New("no content to parse into condition")
+	}
+	var plain, nocase [][]byte
+	cc := &ConditionContent{windowed: make([]*contentPattern, 0)}
+	for _, raw := range values {
+		cp, err := parseContent(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", raw, err)
+		}
+		switch {
+		case cp.offset > 0 || cp.depth > 0:
+			cc.windowed = append(cc.windowed, cp)
+		case cp.nocase:
+			nocase = append(nocase, cp.pattern)
+		default:
+			plain = append(plain, cp.pattern)
+		}
+	}
+	if len(plain) > 0 {
+		cc.anywhere = newAhoCorasick(plain, false)
+	}
+	if len(nocase) > 0 {
+		cc.anywhereNocase = newAhoCorasick(nocase, true)
+	}
+	return cc, nil
+}
+
+// ConditionPCRE matches payload against regular expressions, any match is sufficient
+type ConditionPCRE []*regexp.Regexp
+
+func (cp ConditionPCRE) Match(pkt gopacket.Packet) bool {
+	data := payload(pkt)
+	if len(data) == 0 {
+		return false
+	}
+	for _, re := range cp {
+		if re.Match(data) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+NewConditionPCRE compiles expressions into a Matcher. Expressions can be written as
+/pattern/flags with i, s, m and U flags, or as plain patterns. Go regexp syntax is used, so
+backreferences and lookarounds are not supported.
+*/
+func NewConditionPCRE(values []string) (ConditionPCRE, error) {
+	if len(values) == 0 {
+		return nil, errors.New("no expressions to parse into condition")
+	}
+	cp := make(ConditionPCRE, 0, len(values))
+	for _, raw := range values {
+		expr := raw
+		if strings.HasPrefix(raw, "/") {
+			end := strings.LastIndex(raw, "/")
+			if end == 0 {
+				return nil, fmt.Errorf("%s: missing closing slash", raw)
+			}
+			expr = raw[1:end]
+			if flags := raw[end+1:]; flags != "" {
+				if strings.Trim(flags, "ismU") != "" {
+					return nil, fmt.Errorf("%s: unsupported flags %s", raw, flags)
+				}
+				expr = "(?" + flags + ")" + expr
+			}
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", raw, err)
+		}
+		cp = append(cp, re)
+	}
+	return cp, nil
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  bool
+}
+
+// ahoCorasick is a multi-pattern automaton that reports if any pattern occurs in input
+type ahoCorasick struct {
+	nodes  []acNode
+	nocase bool
+}
+
+func newAhoCorasick(patterns [][]byte, nocase bool) *ahoCorasick {
+	ac := &ahoCorasick{nodes: []acNode{{next: make(map[byte]int32)}}, nocase: nocase}
+	for _, p := range patterns {
+		var state int32
+		for _, b := range p {
+			if nocase {
+				b = toLower(b)
+			}
+			next, ok := ac.nodes[state].next[b]
+			if !ok {
+				ac.nodes = append(ac.nodes, acNode{next: make(map[byte]int32)})
+				next = int32(len(ac.nodes) - 1)
+				ac.nodes[state].next[b] = next
+			}
+			state = next
+		}
+		ac.nodes[state].out = true
+	}
+	// breadth first pass for failure links
+	queue := make([]int32, 0, len(ac.nodes))
+	for _, child := range ac.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for b, child := range ac.nodes[state].next {
+			queue = append(queue, child)
+			fail := ac.nodes[state].fail
+			for {
+				if next, ok := ac.nodes[fail].next[b]; ok && next != child {
+					ac.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			if ac.nodes[ac.nodes[child].fail].out {
+				ac.nodes[child].out = true
+			}
+		}
+	}
+	return ac
+}
+
+func (ac ahoCorasick) match(data []byte) bool {
+	var state int32
+	for _, b := range data {
+		if ac.nocase {
+			b = toLower(b)
+		}
+		for {
+			if next, ok := ac.nodes[state].next[b]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = ac.nodes[state].fail
+		}
+		if ac.nodes[state].out {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerASCII copies data with ASCII letters lowercased, other bytes are kept as-is
+func lowerASCII(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = toLower(b)
+	}
+	return out
+}
+
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
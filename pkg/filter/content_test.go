@@ -0,0 +1,46 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestAhoCorasick(t *testing.T) {
+	ac := newAhoCorasick([][]byte{[]byte("he"), []byte("she"), []byte("hers"), []byte("abcd")}, false)
+	cases := map[string]bool{
+		"ushers":  true,
+		"xxabcxx": false,
+		"xabcdx":  true,
+		"HE":      false,
+		"":        false,
+	}
+	for input, want := range cases {
+		if got := ac.match([]byte(input)); got != want {
+			t.Fatalf("%q: got %t, expected %t", input, got, want)
+		}
+	}
+	nocase := newAhoCorasick([][]byte{[]byte("Evil")}, true)
+	if !nocase.match([]byte("an EVIL domain")) {
+		t.Fatal("nocase automaton should ignore case")
+	}
+}
+
+func TestParseContent(t *testing.T) {
+	cp, err := parseContent("GET|20 2f|admin; offset:2; depth:16; nocase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cp.pattern) != "get /admin" || cp.offset != 2 || cp.depth != 16 || !cp.nocase {
+		t.Fatalf("unexpected parse result %+v", cp)
+	}
+	if !cp.match([]byte("xxGeT /ADMIN HTTP/1.1")) {
+		t.Fatal("pattern within window should match")
+	}
+	if cp.match([]byte("GET /admin HTTP/1.1")) {
+		t.Fatal("pattern before offset should not match")
+	}
+	for _, bad := range []string{"|zz|", "abc|01", "abc; within:3", ""} {
+		if _, err := parseContent(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
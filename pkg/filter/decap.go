@@ -0,0 +1,413 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// well known UDP ports of tunnel protocols
+const (
+	portVXLAN  = 4789
+	portGENEVE = 6081
+	portGTPU   = 2152
+)
+
+const (
+	etherTypeERSPANIII layers.EthernetType = 0x22EB
+	// maxTunnelDepth limits nested decapsulation, guarding against crafted packets
+	maxTunnelDepth = 8
+)
+
+type TunnelType int
+
+const (
+	TunnelNone TunnelType = iota
+	TunnelGRE
+	TunnelERSPANI
+	TunnelERSPANII
+	TunnelERSPANIII
+	TunnelVXLAN
+	TunnelGENEVE
+	TunnelIPIP
+	TunnelGTPU
+	TunnelMPLSoGRE
+)
+
+func (t TunnelType) String() string {
+	switch t {
+	case TunnelGRE:
+		return "gre"
+	case TunnelERSPANI:
+		return "erspan1"
+	case TunnelERSPANII:
+		return "erspan2"
+	case TunnelERSPANIII:
+		return "erspan3"
+	case TunnelVXLAN:
+		return "vxlan"
+	case TunnelGENEVE:
+		return "geneve"
+	case TunnelIPIP:
+		return "ipip"
+	case TunnelGTPU:
+		return "gtpu"
+	case TunnelMPLSoGRE:
+		return "mpls-gre"
+	default:
+		return "none"
+	}
+}
+
+/*
+TunnelLayer describes a single removed encapsulation. ID meaning depends on tunnel type, it
+holds VNI for VXLAN and GENEVE, session ID for ERSPAN, TEID for GTP-U, key for GRE and top
+label for MPLS.
+*/
+type TunnelLayer struct {
+	Type      TunnelType
+	Network   gopacket.Flow
+	Transport gopacket.Flow
+	ID        uint32
+}
+
+// TunnelInfo lists removed encapsulations, outermost first
+type TunnelInfo struct {
+	Layers []TunnelLayer
+}
+
+// Depth returns number of removed encapsulations
+func (ti TunnelInfo) Depth() int {
+	return len(ti.Layers)
+}
+
+/*
+String formats removed encapsulations for packet comments, such as
+"vxlan 192.168.0.1->192.168.0.2 50000->4789 vni=42". Nested tunnels are separated by
+semicolons, outermost first.
+*/
+func (ti TunnelInfo) String() string {
+	parts := make([]string, 0, len(ti.Layers))
+	for _, l := range ti.Layers {
+		var b strings.Builder
+		b.WriteString(l.Type.String())
+		if l.Network.EndpointType() != gopacket.EndpointInvalid {
+			b.WriteString(" " + l.Network.String())
+		}
+		if l.Transport.EndpointType() != gopacket.EndpointInvalid {
+			b.WriteString(" " + l.Transport.String())
+		}
+		if name := l.idName(); name != "" && (l.ID != 0 || l.Type != TunnelGRE) {
+			fmt.Fprintf(&b, " %s=%d", name, l.ID)
+		}
+		parts = append(parts, b.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+/*
+SplitKey identifies mirror session of packet, taken from outermost ERSPAN session ID or
+VXLAN and GENEVE VNI, such as vxlan-42. Empty if no such tunnel was removed.
+*/
+func (ti TunnelInfo) SplitKey() string {
+	for _, l := range ti.Layers {
+		switch l.Type {
+		case TunnelERSPANII, TunnelERSPANIII, TunnelVXLAN, TunnelGENEVE:
+			return fmt.Sprintf("%s-%d", l.Type, l.ID)
+		}
+	}
+	return ""
+}
+
+func (tl TunnelLayer) idName() string {
+	switch tl.Type {
+	case TunnelERSPANII, TunnelERSPANIII:
+		return "session"
+	case TunnelVXLAN, TunnelGENEVE:
+		return "vni"
+	case TunnelGTPU:
+		return "teid"
+	case TunnelGRE:
+		return "key"
+	case TunnelMPLSoGRE:
+		return "label"
+	}
+	return ""
+}
+
+/*
+Decapsulate removes tunnel headers until innermost packet is reached. Supported are GRE,
+ERSPAN I, II and III, VXLAN, GENEVE, IP-in-IP, GTP-U and MPLS over GRE, in any nesting.
+Inner IP packets are framed in a synthetic ethernet header, so decapsulated packets can be
+written to ethernet captures. Packets without tunnel are returned as-is. Only maxLayers
+first layers are checked for tunnel header on each level, values below 1 check all. When a
+level fails to decapsulate, last good packet is returned along with error and removed layers.
+*/
+func Decapsulate(pkt gopacket.Packet, maxLayers int) (gopacket.Packet, TunnelInfo, error) {
+	info := TunnelInfo{Layers: make([]TunnelLayer, 0)}
+	ci := pkt.Metadata().CaptureInfo
+	for info.Depth() < maxTunnelDepth {
+		tunnel, frame, err := findTunnel(pkt, maxLayers)
+		if err != nil {
+			return pkt, info, err
+		}
+		if tunnel.Type == TunnelNone {
+			break
+		}
+		inner := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		if inner.NetworkLayer() == nil && inner.LinkLayer() == nil {
+			return pkt, info, fmt.Errorf("unable to build inner packet from %s", tunnel.Type)
+		}
+		md := inner.Metadata()
+		md.CaptureInfo = ci
+		md.CaptureLength = len(frame)
+		md.Length = len(frame)
+
+		info.Layers = append(info.Layers, tunnel)
+		pkt = inner
+	}
+	return pkt, info, nil
+}
+
+// DecapGREandERSPAN is kept for existing callers, it is a wrapper around Decapsulate
+func DecapGREandERSPAN(pkt gopacket.Packet, maxdepth int) (gopacket.Packet, error) {
+	inner, _, err := Decapsulate(pkt, maxdepth)
+	return inner, err
+}
+
+// findTunnel locates outermost tunnel header and returns inner packet as ethernet frame
+func findTunnel(pkt gopacket.Packet, maxLayers int) (TunnelLayer, []byte, error) {
+	var network gopacket.Flow
+	for i, layer := range pkt.Layers() {
+		if maxLayers > 0 && i+1 == maxLayers {
+			break
+		}
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			network = l.NetworkFlow()
+			if l.Flags&layers.IPv4MoreFragments != 0 || l.FragOffset != 0 {
+				// payload of fragment can not be decapsulated
+				return TunnelLayer{}, nil, nil
+			}
+			if l.Protocol == layers.IPProtocolIPv4 || l.Protocol == layers.IPProtocolIPv6 {
+				frame, err := frameIP(l.Payload)
+				return TunnelLayer{Type: TunnelIPIP, Network: network}, frame, err
+			}
+		case *layers.IPv6:
+			network = l.NetworkFlow()
+			if l.NextHeader == layers.IPProtocolIPv4 || l.NextHeader == layers.IPProtocolIPv6 {
+				frame, err := frameIP(l.Payload)
+				return TunnelLayer{Type: TunnelIPIP, Network: network}, frame, err
+			}
+		case *layers.GRE:
+			tunnel, frame, err := decapGRE(l)
+			tunnel.Network = network
+			return tunnel, frame, err
+		case *layers.UDP:
+			var tunnel TunnelLayer
+			var frame []byte
+			var err error
+			// source port of tunnel packets is picked freely, only destination port is reliable
+			switch l.DstPort {
+			case portVXLAN:
+				tunnel, frame, err = decapVXLAN(l.Payload)
+			case portGENEVE:
+				tunnel, frame, err = decapGENEVE(l.Payload)
+			case portGTPU:
+				tunnel, frame, err = decapGTPU(l.Payload)
+			default:
+				continue
+			}
+			if err != nil {
+				// other UDP traffic can use same port, packet is not tunnelled
+				return TunnelLayer{}, nil, nil
+			}
+			tunnel.Network = network
+			tunnel.Transport = l.TransportFlow()
+			return tunnel, frame, err
+		}
+	}
+	return TunnelLayer{}, nil, nil
+}
+
+func decapGRE(gre *layers.GRE) (TunnelLayer, []byte, error) {
+	tunnel := TunnelLayer{Type: TunnelGRE}
+	if gre.KeyPresent {
+		tunnel.ID = gre.Key
+	}
+	data := gre.Payload
+	switch gre.Protocol {
+	case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6:
+		frame, err := frameIP(data)
+		return tunnel, frame, err
+	case layers.EthernetTypeTransparentEthernetBridging:
+		return tunnel, data, nil
+	case layers.EthernetTypeERSPAN:
+		// type I has no ERSPAN header and is told apart by missing GRE sequence number
+		if !gre.SeqPresent {
+			return TunnelLayer{Type: TunnelERSPANI}, data, nil
+		}
+		if len(data) < 8 {
+			return tunnel, nil, errors.New("truncated ERSPAN II header")
+		}
+		tunnel = TunnelLayer{Type: TunnelERSPANII, ID: uint32(binary.BigEndian.Uint16(data[2:]) & 0x3ff)}
+		return tunnel, data[8:], nil
+	case etherTypeERSPANIII:
+		if len(data) < 12 {
+			return tunnel, nil, errors.New("truncated ERSPAN III header")
+		}
+		tunnel = TunnelLayer{Type: TunnelERSPANIII, ID: uint32(binary.BigEndian.Uint16(data[2:]) & 0x3ff)}
+		size := 12
+		// optional platform specific subheader
+		if data[11]&0x01 != 0 {
+			size += 8
+		}
+		if len(data) < size {
+			return tunnel, nil, errors.New("truncated ERSPAN III subheader")
+		}
+		return tunnel, data[size:], nil
+	case layers.EthernetTypeMPLSUnicast, layers.EthernetTypeMPLSMulticast:
+		return decapMPLS(data)
+	}
+	// payloads such as PPP, WCCP or keepalives are not tunnelled packets
+	return TunnelLayer{}, nil, nil
+}
+
+// decapMPLS removes label stack, payload is IP or ethernet pseudowire with optional control word
+func decapMPLS(data []byte) (TunnelLayer, []byte, error) {
+	tunnel := TunnelLayer{Type: TunnelMPLSoGRE}
+	if len(data) < 4 {
+		return tunnel, nil, errors.New("truncated MPLS header")
+	}
+	tunnel.ID = binary.BigEndian.Uint32(data) >> 12
+	offset := 0
+	for {
+		if offset+4 > len(data) {
+			return tunnel, nil, errors.New("MPLS label stack without bottom")
+		}
+		bottom := data[offset+2]&0x01 == 1
+		offset += 4
+		if bottom {
+			break
+		}
+	}
+	data = data[offset:]
+	if len(data) == 0 {
+		return tunnel, nil, errors.New("empty MPLS payload")
+	}
+	switch data[0] >> 4 {
+	case 4, 6:
+		frame, err := frameIP(data)
+		return tunnel, frame, err
+	case 0:
+		if len(data) < 4 {
+			return tunnel, nil, errors.New("truncated MPLS control word")
+		}
+		return tunnel, data[4:], nil
+	}
+	return tunnel, data, nil
+}
+
+func decapVXLAN(data []byte) (TunnelLayer, []byte, error) {
+	tunnel := TunnelLayer{Type: TunnelVXLAN}
+	if len(data) < 8 {
+		return tunnel, nil, errors.New("truncated VXLAN header")
+	}
+	if data[0]&0x08 == 0 {
+		return tunnel, nil, errors.New("VXLAN header without valid VNI flag")
+	}
+	tunnel.ID = binary.BigEndian.Uint32(data[4:]) >> 8
+	return tunnel, data[8:], nil
+}
+
+func decapGENEVE(data []byte) (TunnelLayer, []byte, error) {
+	tunnel := TunnelLayer{Type: TunnelGENEVE}
+	if len(data) < 8 {
+		return tunnel, nil, errors.New("truncated GENEVE header")
+	}
+	if data[0]>>6 != 0 {
+		return tunnel, nil, fmt.Errorf("unsupported GENEVE version %d", data[0]>>6)
+	}
+	size := 8 + int(data[0]&0x3f)*4
+	if len(data) < size {
+		return tunnel, nil, errors.New("truncated GENEVE options")
+	}
+	tunnel.ID = binary.BigEndian.Uint32(data[4:]) >> 8
+	switch proto := layers.EthernetType(binary.BigEndian.Uint16(data[2:])); proto {
+	case layers.EthernetTypeTransparentEthernetBridging:
+		return tunnel, data[size:], nil
+	case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6:
+		frame, err := frameIP(data[size:])
+		return tunnel, frame, err
+	default:
+		return tunnel, nil, fmt.Errorf("unsupported GENEVE protocol %s", proto)
+	}
+}
+
+// decapGTPU handles G-PDU messages, signaling messages such as echo are not tunneled packets
+func decapGTPU(data []byte) (TunnelLayer, []byte, error) {
+	if len(data) < 8 || data[0]>>5 != 1 || data[0]&0x10 == 0 || data[1] != 0xff {
+		return TunnelLayer{}, nil, nil
+	}
+	tunnel := TunnelLayer{Type: TunnelGTPU, ID: binary.BigEndian.Uint32(data[4:])}
+	size := 8
+	// sequence number, N-PDU number and extension header flags
+	if data[0]&0x07 != 0 {
+		if len(data) < 12 {
+			return tunnel, nil, errors.New("truncated GTP-U header")
+		}
+		size = 12
+		for next := data[11]; next != 0; {
+			if size >= len(data) || data[size] == 0 {
+				return tunnel, nil, errors.New("invalid GTP-U extension header")
+			}
+			extLen := int(data[size]) * 4
+			if size+extLen > len(data) {
+				return tunnel, nil, errors.New("truncated GTP-U extension header")
+			}
+			next = data[size+extLen-1]
+			size += extLen
+		}
+	}
+	frame, err := frameIP(data[size:])
+	return tunnel, frame, err
+}
+
+// frameIP prepends IP packet with ethernet header that has zero addresses
+func frameIP(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty inner packet")
+	}
+	var etherType layers.EthernetType
+	switch data[0] >> 4 {
+	case 4:
+		etherType = layers.EthernetTypeIPv4
+	case 6:
+		etherType = layers.EthernetTypeIPv6
+	default:
+		return nil, fmt.Errorf("inner packet is not IP, version %d", data[0]>>4)
+	}
+	frame := make([]byte, 14, 14+len(data))
+	binary.BigEndian.PutUint16(frame[12:], uint16(etherType))
+	return append(frame, data...), nil
+}
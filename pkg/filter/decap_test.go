@@ -0,0 +1,235 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func encapsulate(t *testing.T, proto layers.IPProtocol, upper []gopacket.SerializableLayer) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IP{192, 168, 0, 1},
+		DstIP:    net.IP{192, 168, 0, 2},
+		Protocol: proto,
+	}
+	stack := []gopacket.SerializableLayer{
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip,
+	}
+	for _, l := range upper {
+		if udp, ok := l.(*layers.UDP); ok {
+			udp.SetNetworkLayerForChecksum(ip)
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}, append(stack, upper...)...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func udpTunnel(t *testing.T, port uint16, header, payload []byte) []byte {
+	return encapsulate(t, layers.IPProtocolUDP, []gopacket.SerializableLayer{
+		&layers.UDP{SrcPort: 50000, DstPort: layers.UDPPort(port)},
+		gopacket.Payload(append(header, payload...)),
+	})
+}
+
+func greTunnel(t *testing.T, proto layers.EthernetType, header, payload []byte) []byte {
+	return encapsulate(t, layers.IPProtocolGRE, []gopacket.SerializableLayer{
+		&layers.GRE{Protocol: proto, SeqPresent: true, Seq: 1},
+		gopacket.Payload(append(header, payload...)),
+	})
+}
+
+func TestDecapsulate(t *testing.T) {
+	frame := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1234, 53).Data()
+	ip := frame[14:]
+
+	erspan3 := make([]byte, 12)
+	binary.BigEndian.PutUint16(erspan3[2:], 0x2000|77)
+	mpls := []byte{0x00, 0x01, 0x41, 0x40}
+
+	cases := []struct {
+		name   string
+		data   []byte
+		tunnel TunnelType
+		id     uint32
+	}{
+		{"vxlan", udpTunnel(t, portVXLAN, []byte{0x08, 0, 0, 0, 0, 0, 42, 0}, frame), TunnelVXLAN, 42},
+		{"geneve", udpTunnel(t, portGENEVE, []byte{0, 0, 0x65, 0x58, 0, 1, 0, 0}, frame), TunnelGENEVE, 256},
+		{"geneve-ip", udpTunnel(t, portGENEVE, []byte{1, 0, 0x08, 0, 0, 0, 7, 0, 0, 0, 0, 0}, ip), TunnelGENEVE, 7},
+		{"gtpu", udpTunnel(t, portGTPU, []byte{0x30, 0xff, 0, 0, 0, 0, 0, 9}, ip), TunnelGTPU, 9},
+		{"gtpu-ext", udpTunnel(t, portGTPU, []byte{0x34, 0xff, 0, 0, 0, 0, 0, 9, 0, 0, 0, 0x85, 1, 0, 0, 0}, ip), TunnelGTPU, 9},
+		{"ipip", encapsulate(t, layers.IPProtocolIPv4, []gopacket.SerializableLayer{gopacket.Payload(ip)}), TunnelIPIP, 0},
+		{"gre-ip", greTunnel(t, layers.EthernetTypeIPv4, nil, ip), TunnelGRE, 0},
+		{"erspan2", greTunnel(t, layers.EthernetTypeERSPAN, []byte{0x10, 0, 0, 5, 0, 0, 0, 0}, frame), TunnelERSPANII, 5},
+		{"erspan3", greTunnel(t, etherTypeERSPANIII, erspan3, frame), TunnelERSPANIII, 77},
+		{"mpls", greTunnel(t, layers.EthernetTypeMPLSUnicast, mpls, ip), TunnelMPLSoGRE, 20},
+	}
+	for _, c := range cases {
+		pkt := gopacket.NewPacket(c.data, layers.LayerTypeEthernet, gopacket.Default)
+		inner, info, err := Decapsulate(pkt, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if info.Depth() != 1 || info.Layers[0].Type != c.tunnel || info.Layers[0].ID != c.id {
+			t.Fatalf("%s: unexpected tunnel info %+v", c.name, info.Layers)
+		}
+		if src, _ := info.Layers[0].Network.Endpoints(); src.String() != "192.168.0.1" {
+			t.Fatalf("%s: unexpected outer source %s", c.name, src)
+		}
+		udp, ok := inner.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok || udp.DstPort != 53 {
+			t.Fatalf("%s: inner packet not decoded", c.name)
+		}
+	}
+
+	// vxlan carried in GRE
+	nested := greTunnel(t, layers.EthernetTypeTransparentEthernetBridging, nil,
+		udpTunnel(t, portVXLAN, []byte{0x08, 0, 0, 0, 0, 0, 1, 0}, frame))
+	inner, info, err := Decapsulate(gopacket.NewPacket(nested, layers.LayerTypeEthernet, gopacket.Default), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Depth() != 2 || info.Layers[0].Type != TunnelGRE || info.Layers[1].Type != TunnelVXLAN {
+		t.Fatalf("unexpected nested tunnel info %+v", info.Layers)
+	}
+	if string(inner.Data()) != string(frame) {
+		t.Fatal("nested decap did not return original frame")
+	}
+
+	plain := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1234, 53)
+	if out, info, err := Decapsulate(plain, 0); err != nil || info.Depth() != 0 || out != plain {
+		t.Fatal("packet without tunnel should be returned as-is")
+	}
+
+	// tunnel ports as source port or with invalid header are regular UDP traffic
+	notTunnelled := map[string][]byte{
+		"vxlan-src": encapsulate(t, layers.IPProtocolUDP, []gopacket.SerializableLayer{
+			&layers.UDP{SrcPort: portVXLAN, DstPort: 50000},
+			gopacket.Payload(append([]byte{0x08, 0, 0, 0, 0, 0, 42, 0}, frame...)),
+		}),
+		"gtpu-src": encapsulate(t, layers.IPProtocolUDP, []gopacket.SerializableLayer{
+			&layers.UDP{SrcPort: portGTPU, DstPort: 50000},
+			gopacket.Payload(append([]byte{0x30, 0xff, 0, 0, 0, 0, 0, 9}, ip...)),
+		}),
+		"vxlan-invalid": udpTunnel(t, portVXLAN, []byte{0, 0, 0, 0, 0, 0, 42, 0}, frame),
+		"geneve-short":  udpTunnel(t, portGENEVE, []byte{0, 0}, nil),
+		"gre-ppp":       greTunnel(t, layers.EthernetType(0x880b), []byte{0xff, 0x03, 0, 0x21}, ip),
+	}
+	for name, data := range notTunnelled {
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		if out, info, err := Decapsulate(pkt, 0); err != nil || info.Depth() != 0 || out != pkt {
+			t.Fatalf("%s: packet should be returned as-is, got depth %d and error %v", name, info.Depth(), err)
+		}
+	}
+}
+
+func TestTunnelInfoString(t *testing.T) {
+	frame := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1234, 53).Data()
+	nested := greTunnel(t, layers.EthernetTypeTransparentEthernetBridging, nil,
+		udpTunnel(t, portVXLAN, []byte{0x08, 0, 0, 0, 0, 0, 42, 0}, frame))
+	_, info, err := Decapsulate(gopacket.NewPacket(nested, layers.LayerTypeEthernet, gopacket.Default), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "gre 192.168.0.1->192.168.0.2; vxlan 192.168.0.1->192.168.0.2 50000->4789 vni=42"
+	if info.String() != expected {
+		t.Fatalf("unexpected comment %q", info.String())
+	}
+	if info.SplitKey() != "vxlan-42" {
+		t.Fatalf("unexpected split key %q", info.SplitKey())
+	}
+	if (TunnelInfo{}).SplitKey() != "" {
+		t.Fatal("packet without tunnel should have empty split key")
+	}
+}
+
+func TestReadAndFilterDecapLinkType(t *testing.T) {
+	frame := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1234, 53).Data()
+	dir := t.TempDir()
+	input := filepath.Join(dir, "raw.pcap")
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	ip := frame[14:]
+	if err := w.WritePacket(gopacket.CaptureInfo{CaptureLength: len(ip), Length: len(ip)}, ip); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	c := &Config{Filter: DummyMatcher{}, Decapsulate: true}
+	c.File.Input = input
+	c.File.Output = filepath.Join(dir, "out.pcap")
+	// decapsulated frames can not be written with raw IP link type
+	if _, err := ReadAndFilter(c); err == nil {
+		t.Fatal("decapsulation of raw IP input should be rejected")
+	}
+	c.Decapsulate = false
+	res, err := ReadAndFilter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Targets[""].Matched != 1 {
+		t.Fatalf("expected 1 matched packet, got %d", res.Targets[""].Matched)
+	}
+}
+
+func TestDecapsulatePartial(t *testing.T) {
+	// vxlan around GRE with truncated ERSPAN II header
+	gre := greTunnel(t, layers.EthernetTypeERSPAN, []byte{0x10, 0}, nil)
+	data := udpTunnel(t, portVXLAN, []byte{0x08, 0, 0, 0, 0, 0, 42, 0}, gre)
+
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	inner, info, err := Decapsulate(pkt, 0)
+	if err == nil {
+		t.Fatal("truncated ERSPAN header should be reported")
+	}
+	if info.Depth() != 1 || info.Layers[0].Type != TunnelVXLAN {
+		t.Fatalf("unexpected tunnel info %+v", info.Layers)
+	}
+	if string(inner.Data()) != string(gre) {
+		t.Fatal("last decapsulated level should be kept on error")
+	}
+
+	pkt.Metadata().CaptureInfo = gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pcap")
+	writeTestInput(t, input, pkt)
+	c := &Config{Filter: DummyMatcher{}, Decapsulate: true}
+	c.File.Input = input
+	c.File.Output = filepath.Join(dir, "out.pcap")
+	res, err := ReadAndFilter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DecapErrors != 1 || res.Targets[""].Matched != 1 {
+		t.Fatalf("got %d decap errors and %d matched, expected 1 and 1",
+			res.DecapErrors, res.Targets[""].Matched)
+	}
+	out := readTestPackets(t, c.File.Output)
+	if len(out) != 1 || string(out[0].Data()) != string(gre) {
+		t.Fatal("partially decapsulated packet not written")
+	}
+}
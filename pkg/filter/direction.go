@@ -0,0 +1,175 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket"
+)
+
+type Direction int
+
+const (
+	DirectionEither Direction = iota
+	DirectionSrc
+	DirectionDst
+	DirectionBoth
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionSrc:
+		return "src"
+	case DirectionDst:
+		return "dst"
+	case DirectionBoth:
+		return "both"
+	default:
+		return "either"
+	}
+}
+
+func NewDirection(raw string) (Direction, error) {
+	switch raw {
+	case "", DirectionEither.String():
+		return DirectionEither, nil
+	case DirectionSrc.String():
+		return DirectionSrc, nil
+	case DirectionDst.String():
+		return DirectionDst, nil
+	case DirectionBoth.String():
+		return DirectionBoth, nil
+	default:
+		return DirectionEither, fmt.Errorf(
+			"invalid direction %s, use one of src, dst, either, both", raw)
+	}
+}
+
+// SidedMatcher is a Matcher that can evaluate source and destination side of packet separately
+type SidedMatcher interface {
+	Matcher
+	// MatchSides reports if source and destination side of packet match criteria
+	MatchSides(gopacket.Packet) (src bool, dst bool)
+}
+
+// DirectionMatcher restricts a sided matcher to source, destination or both sides of packet
+type DirectionMatcher struct {
+	M         SidedMatcher
+	Direction Direction
+}
+
+func (dm DirectionMatcher) Match(pkt gopacket.Packet) bool {
+	src, dst := dm.M.MatchSides(pkt)
+	switch dm.Direction {
+	case DirectionSrc:
+		return src
+	case DirectionDst:
+		return dst
+	case DirectionBoth:
+		return src && dst
+	default:
+		return src || dst
+	}
+}
+
+func NewDirectionMatcher(m Matcher, raw string) (*DirectionMatcher, error) {
+	sm, ok := m.(SidedMatcher)
+	if !ok {
+		return nil, errors.New("direction is not supported for this condition kind")
+	}
+	d, err := NewDirection(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectionMatcher{M: sm, Direction: d}, nil
+}
+
+// negatedSides implements logical NOT separately for each side of packet
+type negatedSides struct {
+	M SidedMatcher
+}
+
+func (ns negatedSides) Match(pkt gopacket.Packet) bool {
+	src, dst := ns.MatchSides(pkt)
+	return src || dst
+}
+
+func (ns negatedSides) MatchSides(pkt gopacket.Packet) (bool, bool) {
+	// packets without addresses have no sides to negate
+	if pkt.NetworkLayer() == nil {
+		return false, false
+	}
+	src, dst := ns.M.MatchSides(pkt)
+	return !src, !dst
+}
+
+/*
+FlowMatcher matches packets where source side matches Src and destination side matches Dst.
+Unless Oneway is set, reverse direction is also matched so both halves of a flow are kept.
+*/
+type FlowMatcher struct {
+	Src, Dst SidedMatcher
+	Oneway   bool
+}
+
+func (fm FlowMatcher) Match(pkt gopacket.Packet) bool {
+	srcA, dstA := fm.Src.MatchSides(pkt)
+	srcB, dstB := fm.Dst.MatchSides(pkt)
+	if srcA && dstB {
+		return true
+	}
+	return !fm.Oneway && dstA && srcB
+}
+
+func (c MatcherConfig) newFlowMatcher(item FilterItem, path string) (*FlowMatcher, error) {
+	if item.Src == nil || item.Dst == nil {
+		return nil, fmt.Errorf("%s: %s kind needs both src and dst conditions", path, FilterKindFlow)
+	}
+	if len(item.Match) > 0 || item.Direction != "" {
+		return nil, fmt.Errorf("%s: %s kind does not support match nor direction", path, FilterKindFlow)
+	}
+	src, err := c.newSidedMatcher(*item.Src, path+".src")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := c.newSidedMatcher(*item.Dst, path+".dst")
+	if err != nil {
+		return nil, err
+	}
+	return &FlowMatcher{Src: src, Dst: dst, Oneway: item.Oneway}, nil
+}
+
+func (c MatcherConfig) newSidedMatcher(item FilterItem, path string) (SidedMatcher, error) {
+	if item.Kind == "" || item.Any != nil || item.All != nil || item.Not != nil ||
+		item.Src != nil || item.Dst != nil || item.Direction != "" {
+		return nil, fmt.Errorf("%s: flow endpoint must be a single condition with kind and match", path)
+	}
+	m, err := c.newLeafMatcher(item)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	sm, ok := m.(SidedMatcher)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s kind can not be used as flow endpoint", path, item.Kind)
+	}
+	if item.Negate {
+		return negatedSides{M: sm}, nil
+	}
+	return sm, nil
+}
@@ -18,17 +18,19 @@ package filter
 
 import (
 	"bufio"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/StamusNetworks/gophercap/pkg/dedup"
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
 )
 
@@ -44,24 +46,62 @@ type Config struct {
 		Input  string
 		Output string
 	}
-	// BPF filter object, only packets matching network list will be written to OutFile
+	// Filter object, only packets matching conditions will be written to OutFile. Evaluated
+	// after optional decapsulation, so conditions apply to inner packet.
 	Filter Matcher
-	// Enable GRE and ERSPAN packet decapsulation
+	// Targets allow input to be read once for many filters, File.Output and Filter are
+	// ignored when defined
+	Targets []Target
+	// Enable tunnel decapsulation, see Decapsulate for supported tunnels
 	Decapsulate bool
 	// How many layers should be checked for decapsulation
 	DecapMaxDepth int
+	// Remove VLAN tags and MPLS labels from matched packets before writing
+	StripVLAN bool
+	StripMPLS bool
+	// FlowMode enables keeping whole flows once a packet matches, flows are tracked within input
+	FlowMode FlowMode
+	// FlowTimeout is idle timeout for flows tracked in follow mode
+	FlowTimeout time.Duration
 
 	Compress bool
+	// Pcapng writes pcapng outputs, with outer tunnel metadata as packet comments when
+	// decapsulating
+	Pcapng bool
+	// SplitTunnel writes a separate output per ERSPAN session or VXLAN and GENEVE VNI
+	SplitTunnel bool
+	// RotateBytes splits output into multiple files of roughly this size, 0 disables
+	RotateBytes int64
 
 	StatFunc func(map[string]any)
 
 	Ctx context.Context
 
 	Dedup dedup.Dedupper
+	// DedupInner deduplicates on packet inside tunnels even when output is not decapsulated
+	DedupInner bool
+}
+
+// Target is a single filter with its own output when reading input once for many filters
+type Target struct {
+	Name   string
+	Output string
+	Filter Matcher
+	// Writer replaces Output file when defined, for layouts such as per-flow files
+	Writer PacketWriter
+}
+
+// TargetResult holds packet counts for a single target
+type TargetResult struct {
+	Matched int
+	Skipped int
+	// Files lists written outputs, empty if no packet matched or custom Writer was used
+	Files []rotate.File
 }
 
 type FilterResult struct {
-	Count        int
+	Count int
+	// Matched counts packets written to at least one target
 	Matched      int
 	Errors       int
 	DecapErrors  int
@@ -71,6 +111,8 @@ type FilterResult struct {
 	Rate         string
 	Deduplicated int
 	DedupRatio   float64
+
+	Targets map[string]*TargetResult
 }
 
 func (fr FilterResult) Map() map[string]any {
@@ -88,53 +130,327 @@ func (fr FilterResult) Map() map[string]any {
 	}
 }
 
+type FlowMode int
+
+const (
+	// FlowModePacket decides on each packet separately
+	FlowModePacket FlowMode = iota
+	// FlowModeFollow keeps all packets of a flow that follow first matching packet
+	FlowModeFollow
+	// FlowModeTwoPass reads input twice, so packets preceding first match are also kept
+	FlowModeTwoPass
+)
+
+func (m FlowMode) String() string {
+	switch m {
+	case FlowModeFollow:
+		return "follow"
+	case FlowModeTwoPass:
+		return "two-pass"
+	default:
+		return "packet"
+	}
+}
+
+func NewFlowMode(raw string) (FlowMode, error) {
+	switch raw {
+	case "", FlowModePacket.String():
+		return FlowModePacket, nil
+	case FlowModeFollow.String():
+		return FlowModeFollow, nil
+	case FlowModeTwoPass.String():
+		return FlowModeTwoPass, nil
+	default:
+		return FlowModePacket, fmt.Errorf("invalid flow mode %s, use one of packet, follow, two-pass", raw)
+	}
+}
+
 /*
 ReadAndFilter processes a PCAP file, storing packets that match filtering
-criteria in output file
+criteria in output file. When multiple targets are defined, input is read only once and each
+packet is evaluated against all of them. Output files are created on first match, so no empty
+outputs are written.
 */
 func ReadAndFilter(c *Config) (*FilterResult, error) {
-	f, err := os.Open(c.File.Input)
+	input, f, err := openInput(c.File.Input)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	f.Close()
+	// inner packets are ethernet frames, so only ethernet input keeps output consistent
+	if c.Decapsulate && input.LinkType() != layers.LinkTypeEthernet {
+		return nil, fmt.Errorf("decapsulation needs ethernet input, %s has link type %s",
+			c.File.Input, input.LinkType())
+	}
 
-	input, err := pcapgo.NewReader(bufio.NewReader(f))
+	targets := c.Targets
+	if len(targets) == 0 {
+		targets = []Target{{Output: c.File.Output, Filter: c.Filter}}
+	}
+	res := &FilterResult{Start: time.Now(), Targets: make(map[string]*TargetResult, len(targets))}
+
+	states := make([]*targetState, 0, len(targets))
+	defer func() {
+		for _, t := range states {
+			t.close()
+		}
+	}()
+	for _, t := range targets {
+		if _, ok := res.Targets[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate filter target %s", t.Name)
+		}
+		state := &targetState{Target: t, res: &TargetResult{}}
+		// sticky conditions track flows of this input only
+		state.Filter = NewFlowScope(t.Filter)
+		if err := state.open(c, input); err != nil {
+			return nil, err
+		}
+		res.Targets[t.Name] = state.res
+		states = append(states, state)
+	}
+
+	dedupDrop := func(pkt gopacket.Packet) bool {
+		if c.Dedup == nil {
+			return false
+		}
+		if c.DedupInner && !c.Decapsulate {
+			// same inner packet is often mirrored through many tunnels
+			// on error, outer levels that were removed are still kept
+			pkt, _, _ = Decapsulate(pkt, c.DecapMaxDepth)
+		}
+		if c.Dedup.Drop(pkt) {
+			res.Deduplicated++
+			res.DedupRatio = (float64(res.Deduplicated) / float64(res.Count)) * 100
+			return true
+		}
+		return false
+	}
+	// evaluate is called for each packet that needs to be written or skipped by each target
+	evaluate := func(pkt gopacket.Packet, tunnel TunnelInfo, keep func(*targetState) bool) error {
+		var written bool
+		for _, t := range states {
+			if !keep(t) {
+				t.res.Skipped++
+				continue
+			}
+			if !written && (c.StripVLAN || c.StripMPLS) {
+				pkt = StripVLANandMPLS(pkt, c.StripVLAN, c.StripMPLS)
+			}
+			if err := t.write(c, pkt, tunnel); err != nil {
+				return err
+			}
+			written = true
+		}
+		if written {
+			res.Matched++
+		} else {
+			res.Skipped++
+		}
+		return nil
+	}
+
+	switch c.FlowMode {
+	case FlowModeTwoPass:
+		// packet indexes are stable between passes, dedup and non-IP matches are recorded by index
+		dropped := make(map[int]bool)
+		for _, t := range states {
+			t.flowSet = make(map[FlowKey]bool)
+			t.matched = make(map[int]bool)
+		}
+		err = c.readPackets(res, true, func(idx int, pkt gopacket.Packet, tunnel TunnelInfo) error {
+			if dedupDrop(pkt) {
+				dropped[idx] = true
+				return nil
+			}
+			key, ok := NewFlowKey(pkt)
+			for _, t := range states {
+				if !t.Filter.Match(pkt) {
+					continue
+				}
+				if ok {
+					t.flowSet[key] = true
+				} else {
+					t.matched[idx] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+		err = c.readPackets(res, false, func(idx int, pkt gopacket.Packet, tunnel TunnelInfo) error {
+			if dropped[idx] {
+				return nil
+			}
+			key, ok := NewFlowKey(pkt)
+			return evaluate(pkt, tunnel, func(t *targetState) bool {
+				return t.matched[idx] || (ok && t.flowSet[key])
+			})
+		})
+	default:
+		if c.FlowMode == FlowModeFollow {
+			for _, t := range states {
+				t.flows = NewFlowTable(c.FlowTimeout)
+			}
+		}
+		err = c.readPackets(res, true, func(idx int, pkt gopacket.Packet, tunnel TunnelInfo) error {
+			if dedupDrop(pkt) {
+				return nil
+			}
+			var key FlowKey
+			var hasKey bool
+			if c.FlowMode == FlowModeFollow {
+				key, hasKey = NewFlowKey(pkt)
+			}
+			ts := pkt.Metadata().Timestamp
+			return evaluate(pkt, tunnel, func(t *targetState) bool {
+				if t.flows == nil {
+					return t.Filter.Match(pkt)
+				}
+				if hasKey && t.flows.Seen(key, ts) {
+					return true
+				}
+				if !t.Filter.Match(pkt) {
+					return false
+				}
+				if hasKey {
+					t.flows.Add(key, ts)
+				}
+				return true
+			})
+		})
+	}
+	for _, t := range states {
+		if cerr := t.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return res, err
+}
+
+// targetState holds output and flow tracking for a single target during ReadAndFilter
+type targetState struct {
+	Target
+
+	res *TargetResult
+
+	source   string
+	linkType layers.LinkType
+	snaplen  uint32
+	// writers are keyed by tunnel split key, empty key is for packets without tunnel
+	writers map[string]*rotate.Writer
+
+	flows   *FlowTable
+	flowSet map[FlowKey]bool
+	matched map[int]bool
+}
+
+// open prepares target output, files are only created once first packet is written
+func (t *targetState) open(c *Config, input *pcapgo.Reader) error {
+	t.source = c.File.Input
+	t.linkType = input.LinkType()
+	t.snaplen = uint32(input.Snaplen())
+	t.writers = make(map[string]*rotate.Writer)
+	if t.Writer != nil {
+		return nil
+	}
+	_, err := t.writer(c, "")
+	return err
+}
+
+// writer returns output for split key, base name is suffixed with key when splitting
+func (t *targetState) writer(c *Config, key string) (*rotate.Writer, error) {
+	if w, ok := t.writers[key]; ok {
+		return w, nil
+	}
+	base := filepath.Base(t.Output)
+	ext := filepath.Ext(base)
+	template := strings.TrimSuffix(base, ext)
+	if key != "" {
+		template += "." + key
+	}
+	if c.RotateBytes > 0 {
+		template += ".%t"
+	}
+	w, err := rotate.NewWriter(rotate.Config{
+		Dir:      filepath.Dir(t.Output),
+		Template: template + ext,
+		LinkType: t.linkType,
+		Snaplen:  t.snaplen,
+		Compress: c.Compress,
+		Pcapng:   c.Pcapng,
+		MaxBytes: c.RotateBytes,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("infile open: %s", err)
+		return nil, err
 	}
-	input.SetSnaplen(1024 * 64)
+	t.writers[key] = w
+	return w, nil
+}
 
-	var writer io.Writer
-	fp := c.File.Output
-	if c.Compress {
-		fp += ".gz"
+func (t *targetState) write(c *Config, pkt gopacket.Packet, tunnel TunnelInfo) error {
+	t.res.Matched++
+	if t.Writer != nil {
+		return t.Writer.WritePacket(pkt, t.linkType, t.source)
 	}
-	output, err := os.Create(fp)
+	var key string
+	if c.SplitTunnel {
+		key = tunnel.SplitKey()
+	}
+	w, err := t.writer(c, key)
 	if err != nil {
-		return nil, fmt.Errorf("outfile create: %s", err)
+		return err
+	}
+	var comment string
+	if c.Pcapng && tunnel.Depth() > 0 {
+		comment = tunnel.String()
 	}
-	defer output.Close()
+	return w.WritePacketComment(pkt.Metadata().CaptureInfo, pkt.Data(), comment)
+}
 
-	bufWriter := bufio.NewWriterSize(output, 1024*64)
-	defer bufWriter.Flush()
+// close flushes outputs, safe to call multiple times
+func (t *targetState) close() error {
+	var err error
+	files := make([]rotate.File, 0, len(t.writers))
+	for _, w := range t.writers {
+		if cerr := w.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		files = append(files, w.Files()...)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	t.res.Files = files
+	return err
+}
 
-	if c.Compress {
-		gw := gzip.NewWriter(bufWriter)
-		defer gw.Close()
-		writer = gw
-	} else {
-		writer = bufWriter
+func openInput(path string) (*pcapgo.Reader, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	input, err := pcapgo.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("infile open: %s", err)
 	}
+	input.SetSnaplen(1024 * 64)
+	return input, f, nil
+}
 
-	w := pcapgo.NewWriter(writer)
-	if err := w.WriteFileHeader(uint32(input.Snaplen()), input.LinkType()); err != nil {
-		return nil, err
+/*
+readPackets does a single pass over input file, decapsulating packets if needed. Packet index
+counts all packets in file, including broken ones, so it can be used to refer to same packet
+in another pass. Read stats are only collected when count is set.
+*/
+func (c *Config) readPackets(res *FilterResult, count bool, fn func(int, gopacket.Packet, TunnelInfo) error) error {
+	input, f, err := openInput(c.File.Input)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
 	report := time.NewTicker(5 * time.Second)
-
-	res := &FilterResult{Start: time.Now()}
+	defer report.Stop()
 
 	var ctx context.Context
 	if c.Ctx == nil {
@@ -143,11 +459,10 @@ func ReadAndFilter(c *Config) (*FilterResult, error) {
 		ctx = c.Ctx
 	}
 
-loop:
-	for {
+	for idx := 0; ; idx++ {
 		select {
 		case <-ctx.Done():
-			return res, ErrEarlyExit{}
+			return ErrEarlyExit{}
 		case <-report.C:
 			res.Took = time.Since(res.Start)
 			res.Rate = fmt.Sprintf("%.2f pps", float64(res.Count)/res.Took.Seconds())
@@ -156,43 +471,40 @@ loop:
 			}
 		default:
 		}
-		res.Count++
-
 		raw, ci, err := input.ReadPacketData()
 		if err != nil && err == io.EOF {
-			break loop
-		} else if err != nil {
-			res.Errors++
-			continue loop
+			return nil
+		}
+		if count {
+			res.Count++
+		}
+		if err != nil {
+			if count {
+				res.Errors++
+			}
+			continue
 		}
 		pkt := gopacket.NewPacket(raw, input.LinkType(), gopacket.Default)
+		var tunnel TunnelInfo
 		if c.Decapsulate {
-			pkt, err = DecapGREandERSPAN(pkt, c.DecapMaxDepth)
+			pkt, tunnel, err = Decapsulate(pkt, c.DecapMaxDepth)
 			if err != nil {
-				res.DecapErrors++
-				continue loop
-			}
-		}
-		if c.Dedup != nil {
-			if c.Dedup.Drop(pkt) {
-				res.Deduplicated++
-				res.DedupRatio = (float64(res.Deduplicated) / float64(res.Count)) * 100
-				continue loop
+				if count {
+					res.DecapErrors++
+				}
+				// packet is kept decapsulated up to failed level
+				if tunnel.Depth() == 0 {
+					continue
+				}
 			}
 		}
 		ci.CaptureLength = len(pkt.Data())
 		ci.Length = len(pkt.Data())
 		pkt.Metadata().CaptureInfo = ci
-		if c.Filter.Match(pkt) {
-			if err := w.WritePacket(pkt.Metadata().CaptureInfo, pkt.Data()); err != nil {
-				return res, err
-			}
-			res.Matched++
-		} else {
-			res.Skipped++
+		if err := fn(idx, pkt, tunnel); err != nil {
+			return err
 		}
 	}
-	return res, nil
 }
 
 // Task is input file to be fed to filter reader, along with BPF filter used to extract packets
@@ -201,6 +513,9 @@ type Task struct {
 
 	Filter      Matcher
 	Description string
+
+	// Targets are set instead of Output and Filter when input is read once for many filters
+	Targets []Target
 }
 
 func ExtractBaseName(filename string) string {
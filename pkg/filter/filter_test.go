@@ -0,0 +1,340 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/dedup"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// udpAt builds udp packet with capture timestamp
+func udpAt(src, dst net.IP, sport, dport uint16, ts time.Time) gopacket.Packet {
+	pkt := buildPacketUDP(src, dst, sport, dport)
+	pkt.Metadata().CaptureInfo = gopacket.CaptureInfo{
+		Timestamp:     ts,
+		CaptureLength: len(pkt.Data()),
+		Length:        len(pkt.Data()),
+	}
+	return pkt
+}
+
+func writeTestInput(t *testing.T, path string, pkts ...gopacket.Packet) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range pkts {
+		if err := w.WritePacket(pkt.Metadata().CaptureInfo, pkt.Data()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestOutput returns timestamps of packets in pcap file, missing file has none
+func readTestOutput(t *testing.T, path string) []time.Time {
+	t.Helper()
+	var out []time.Time
+	for _, pkt := range readTestPackets(t, path) {
+		out = append(out, pkt.Metadata().Timestamp)
+	}
+	return out
+}
+
+// readTestPackets decodes packets of ethernet pcap file, missing file has none
+func readTestPackets(t *testing.T, path string) []gopacket.Packet {
+	t.Helper()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []gopacket.Packet
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			return out
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		pkt.Metadata().CaptureInfo = ci
+		out = append(out, pkt)
+	}
+}
+
+func TestReadAndFilterStickyScope(t *testing.T) {
+	m, err := newTestMatcher(t, `
+conditions:
+  - kind: port
+    match: [4444/udp]
+    direction: src
+    sticky: true
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1600000000, 0).UTC()
+	a, b := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	dir := t.TempDir()
+	newer := filepath.Join(dir, "newer.pcap")
+	writeTestInput(t, newer,
+		udpAt(b, a, 5555, 4444, ts.Add(100*time.Second)),
+		udpAt(a, b, 4444, 5555, ts.Add(101*time.Second)),
+		udpAt(b, a, 5555, 4444, ts.Add(102*time.Second)),
+	)
+	// earlier session of same flow in a rotated file, filtered after newer one
+	older := filepath.Join(dir, "older.pcap")
+	writeTestInput(t, older,
+		udpAt(b, a, 5555, 4444, ts),
+		udpAt(b, a, 5555, 4444, ts.Add(time.Second)),
+	)
+	// same flow seen on another link, no packet matches there
+	other := filepath.Join(dir, "other.pcap")
+	writeTestInput(t, other, udpAt(b, a, 5555, 4444, ts.Add(103*time.Second)))
+
+	cases := []struct {
+		input    string
+		expected []time.Time
+	}{
+		{input: newer, expected: []time.Time{ts.Add(101 * time.Second), ts.Add(102 * time.Second)}},
+		{input: older},
+		{input: other},
+	}
+	for _, tc := range cases {
+		c := &Config{Filter: m}
+		c.File.Input = tc.input
+		c.File.Output = tc.input + ".out"
+		if _, err := ReadAndFilter(c); err != nil {
+			t.Fatal(err)
+		}
+		got := readTestOutput(t, c.File.Output)
+		if len(got) != len(tc.expected) {
+			t.Fatalf("%s: got %d packets, expected %d", tc.input, len(got), len(tc.expected))
+		}
+		for i := range got {
+			if !got[i].Equal(tc.expected[i]) {
+				t.Fatalf("%s: packet %d at %s, expected %s", tc.input, i, got[i], tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestNewFlowScope(t *testing.T) {
+	hits := &ConditionHits{}
+	var cfg CombinedConfig
+	cfg.Conditions = []FilterItem{{Kind: "port", Match: []string{"4444/udp"}, Direction: "src", Sticky: true}}
+	m, err := NewCombinedMatcher(MatcherConfig{CombinedConfig: cfg, Hits: hits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1600000000, 0)
+	a, b := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	first, second := NewFlowScope(m), NewFlowScope(m)
+	if !first.Match(udpAt(a, b, 4444, 5555, ts)) {
+		t.Fatal("inner condition should match")
+	}
+	if !first.Match(udpAt(b, a, 5555, 4444, ts.Add(time.Second))) {
+		t.Fatal("flow should stick within scope")
+	}
+	if second.Match(udpAt(b, a, 5555, 4444, ts.Add(time.Second))) {
+		t.Fatal("flow state should not be shared between scopes")
+	}
+	if stats := hits.Conditions(); len(stats) != 1 || stats[0].Evaluated != 3 || stats[0].Hits != 2 {
+		t.Fatalf("hit counts should be shared between scopes, got %+v", stats)
+	}
+	plain := CombinedMatcher{Conditions: []Matcher{DummyMatcher{}}}
+	if _, ok := flowScope(plain); ok {
+		t.Fatal("matcher without sticky conditions should not be copied")
+	}
+}
+
+func arpAt(src net.HardwareAddr, ts time.Time) gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       src,
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeARP,
+		},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   src,
+			SourceProtAddress: []byte{10, 0, 0, 1},
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    []byte{10, 0, 0, 2},
+		},
+	); err != nil {
+		panic(err)
+	}
+	pkt := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	pkt.Metadata().CaptureInfo = gopacket.CaptureInfo{
+		Timestamp:     ts,
+		CaptureLength: len(pkt.Data()),
+		Length:        len(pkt.Data()),
+	}
+	return pkt
+}
+
+func TestReadAndFilterFlowModes(t *testing.T) {
+	m, err := newTestMatcher(t, `
+conditions:
+  - any:
+      - kind: port
+        match: [53/udp]
+        direction: src
+      - kind: ether
+        match: ["02:00:00:00:00:01"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1600000000, 0).UTC()
+	at := func(i int) time.Time { return ts.Add(time.Duration(i) * time.Second) }
+	client, server, other := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 3}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pcap")
+	writeTestInput(t, input,
+		// query precedes first matching packet of flow
+		udpAt(client, server, 1111, 53, at(0)),
+		udpAt(server, client, 53, 1111, at(1)),
+		udpAt(client, server, 1111, 53, at(2)),
+		// copy of previous packet, dropped by dedup
+		udpAt(client, server, 1111, 53, at(2).Add(time.Millisecond)),
+		arpAt(net.HardwareAddr{2, 0, 0, 0, 0, 1}, at(3)),
+		arpAt(net.HardwareAddr{2, 0, 0, 0, 0, 2}, at(4)),
+		udpAt(client, other, 2222, 80, at(5)),
+		udpAt(server, client, 53, 1111, at(7)),
+	)
+
+	cases := map[FlowMode][]int{
+		FlowModePacket:  {1, 3, 7},
+		FlowModeFollow:  {1, 2, 3, 7},
+		FlowModeTwoPass: {0, 1, 2, 3, 7},
+	}
+	for mode, expected := range cases {
+		d, err := dedup.NewWindowDedup(dedup.WindowConfig{Window: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{Filter: m, FlowMode: mode, Dedup: d}
+		c.File.Input = input
+		c.File.Output = filepath.Join(dir, mode.String()+".pcap")
+		res, err := ReadAndFilter(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Count != 8 || res.Deduplicated != 1 {
+			t.Fatalf("%s: read %d packets with %d duplicates, expected 8 with 1", mode, res.Count, res.Deduplicated)
+		}
+		got := readTestOutput(t, c.File.Output)
+		if len(got) != len(expected) || res.Matched != len(expected) {
+			t.Fatalf("%s: wrote %d and matched %d packets, expected %d", mode, len(got), res.Matched, len(expected))
+		}
+		for i, idx := range expected {
+			if !got[i].Equal(at(idx)) {
+				t.Fatalf("%s: packet %d at %s, expected packet from %s", mode, i, got[i], at(idx))
+			}
+		}
+	}
+}
+
+func TestReadAndFilterTargets(t *testing.T) {
+	ts := time.Unix(1600000000, 0).UTC()
+	tagged := buildPacketTagged()
+	tagged.Metadata().CaptureInfo = gopacket.CaptureInfo{
+		Timestamp:     ts,
+		CaptureLength: len(tagged.Data()),
+		Length:        len(tagged.Data()),
+	}
+	a, b := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pcap")
+	writeTestInput(t, input,
+		tagged,
+		udpAt(a, b, 1234, 80, ts.Add(time.Second)),
+		udpAt(a, b, 1234, 53, ts.Add(2*time.Second)),
+	)
+
+	target := func(name, raw string) Target {
+		m, err := newTestMatcher(t, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(filepath.Join(dir, name), 0750); err != nil {
+			t.Fatal(err)
+		}
+		return Target{Name: name, Output: filepath.Join(dir, name, "in.pcap"), Filter: m}
+	}
+	// vlan target is evaluated after dns target has written stripped packet
+	c := &Config{
+		Targets: []Target{
+			target("dns", "conditions: [{kind: port, match: [53/udp]}]"),
+			target("vlan", "conditions: [{kind: vlan, match: [\"100\"]}]"),
+		},
+		StripVLAN: true,
+	}
+	c.File.Input = input
+	res, err := ReadAndFilter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 3 || res.Matched != 2 || res.Skipped != 1 {
+		t.Fatalf("unexpected totals %+v", res)
+	}
+	cases := map[string]struct {
+		matched, skipped int
+		packets          []time.Time
+	}{
+		"dns":  {matched: 2, skipped: 1, packets: []time.Time{ts, ts.Add(2 * time.Second)}},
+		"vlan": {matched: 1, skipped: 2, packets: []time.Time{ts}},
+	}
+	stripped := StripVLANandMPLS(tagged, true, false).Data()
+	for name, expected := range cases {
+		tr := res.Targets[name]
+		if tr == nil || tr.Matched != expected.matched || tr.Skipped != expected.skipped {
+			t.Fatalf("%s: unexpected result %+v", name, tr)
+		}
+		output := filepath.Join(dir, name, "in.pcap")
+		if len(tr.Files) != 1 || tr.Files[0].Path != output {
+			t.Fatalf("%s: unexpected outputs %+v", name, tr.Files)
+		}
+		pkts := readTestPackets(t, output)
+		if len(pkts) != len(expected.packets) {
+			t.Fatalf("%s: got %d packets, expected %d", name, len(pkts), len(expected.packets))
+		}
+		for i, pkt := range pkts {
+			if !pkt.Metadata().Timestamp.Equal(expected.packets[i]) {
+				t.Fatalf("%s: packet %d at %s, expected %s", name, i, pkt.Metadata().Timestamp, expected.packets[i])
+			}
+		}
+		if !bytes.Equal(pkts[0].Data(), stripped) {
+			t.Fatalf("%s: vlan tags should be stripped once, got %x", name, pkts[0].Data())
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// DefaultFlowTimeout is idle time after which flow is forgotten
+const DefaultFlowTimeout = 10 * time.Minute
+
+// FlowKey identifies a flow regardless of packet direction
+type FlowKey struct {
+	Network, Transport gopacket.Flow
+}
+
+// NewFlowKey builds a direction independent key from packet network and transport endpoints
+func NewFlowKey(pkt gopacket.Packet) (FlowKey, bool) {
+	n := pkt.NetworkLayer()
+	if n == nil {
+		return FlowKey{}, false
+	}
+	key := FlowKey{Network: n.NetworkFlow()}
+	if t := pkt.TransportLayer(); t != nil {
+		key.Transport = t.TransportFlow()
+	}
+	src, dst := key.Network.Endpoints()
+	if dst.LessThan(src) {
+		key.Network = key.Network.Reverse()
+		key.Transport = key.Transport.Reverse()
+	} else if src == dst {
+		if tsrc, tdst := key.Transport.Endpoints(); tdst.LessThan(tsrc) {
+			key.Transport = key.Transport.Reverse()
+		}
+	}
+	return key, true
+}
+
+/*
+FlowTable tracks flows by first matched and last seen packet timestamp. Packet time is used
+instead of wall clock, so timeouts behave the same when reading old captures. Table should
+only be fed packets of a single input, as timestamps of separate inputs are not comparable.
+Safe for concurrent use.
+*/
+type FlowTable struct {
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	flows   map[FlowKey]flowSeen
+	inserts int
+}
+
+type flowSeen struct {
+	first, last time.Time
+}
+
+func NewFlowTable(timeout time.Duration) *FlowTable {
+	if timeout <= 0 {
+		timeout = DefaultFlowTimeout
+	}
+	return &FlowTable{Timeout: timeout, flows: make(map[FlowKey]flowSeen)}
+}
+
+// Add marks flow as matched at ts
+func (ft *FlowTable) Add(key FlowKey, ts time.Time) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	seen, ok := ft.flows[key]
+	if !ok || ts.Before(seen.first) {
+		seen.first = ts
+	}
+	if ts.After(seen.last) {
+		seen.last = ts
+	}
+	ft.flows[key] = seen
+	ft.inserts++
+	if ft.inserts%(1<<16) == 0 {
+		ft.expire(ts)
+	}
+}
+
+/*
+Seen reports if flow is tracked and not timed out, last seen time is refreshed on hit. Packets
+before first match of flow are not seen, so earlier sessions with same endpoints are not kept.
+*/
+func (ft *FlowTable) Seen(key FlowKey, ts time.Time) bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	seen, ok := ft.flows[key]
+	if !ok || ts.Before(seen.first) {
+		return false
+	}
+	if ts.Sub(seen.last) > ft.Timeout {
+		delete(ft.flows, key)
+		return false
+	}
+	if ts.After(seen.last) {
+		seen.last = ts
+		ft.flows[key] = seen
+	}
+	return true
+}
+
+// Len returns number of tracked flows
+func (ft *FlowTable) Len() int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return len(ft.flows)
+}
+
+func (ft *FlowTable) expire(now time.Time) {
+	for key, seen := range ft.flows {
+		if now.Sub(seen.last) > ft.Timeout {
+			delete(ft.flows, key)
+		}
+	}
+}
+
+/*
+StickyMatcher extends a match to all subsequent packets of same flow. Useful for conditions
+that only match some packets of a flow, such as DNS name or TLS SNI. Flow state belongs to a
+single input, see NewFlowScope.
+*/
+type StickyMatcher struct {
+	M     Matcher
+	Flows *FlowTable
+}
+
+func (sm StickyMatcher) Match(pkt gopacket.Packet) bool {
+	key, ok := NewFlowKey(pkt)
+	ts := pkt.Metadata().Timestamp
+	if ok && sm.Flows.Seen(key, ts) {
+		return true
+	}
+	if !sm.M.Match(pkt) {
+		return false
+	}
+	if ok {
+		sm.Flows.Add(key, ts)
+	}
+	return true
+}
+
+func (sm StickyMatcher) withFreshFlows() (Matcher, bool) {
+	inner, _ := flowScope(sm.M)
+	return StickyMatcher{M: inner, Flows: NewFlowTable(sm.Flows.Timeout)}, true
+}
+
+// flowScoped is implemented by matchers that keep flow state or contain such matchers
+type flowScoped interface {
+	// withFreshFlows returns copy with empty flow state and false if matcher has no state
+	withFreshFlows() (Matcher, bool)
+}
+
+/*
+NewFlowScope returns copy of matcher tree with empty flow state for sticky conditions, so a
+tree shared by concurrently filtered inputs tracks flows of each input separately. Condition
+hit counts stay shared. Matchers without flow state are returned as is.
+*/
+func NewFlowScope(m Matcher) Matcher {
+	m, _ = flowScope(m)
+	return m
+}
+
+func flowScope(m Matcher) (Matcher, bool) {
+	if fs, ok := m.(flowScoped); ok {
+		return fs.withFreshFlows()
+	}
+	return m, false
+}
+
+// flowScopeAll copies matchers into a new slice only if any of them keeps flow state
+func flowScopeAll(ms []Matcher) ([]Matcher, bool) {
+	var out []Matcher
+	for i, m := range ms {
+		scoped, ok := flowScope(m)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = append([]Matcher{}, ms...)
+		}
+		out[i] = scoped
+	}
+	if out == nil {
+		return ms, false
+	}
+	return out, true
+}
@@ -0,0 +1,180 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoCacheSize limits number of cached lookups, cache is flushed once full
+const geoCacheSize = 1 << 20
+
+type geoRecord struct {
+	Country   string
+	Continent string
+	City      string
+	CityID    uint
+}
+
+/*
+geoDB wraps a maxmind reader with lookup cache. Same database is shared by all conditions that
+refer to it, so cache persists over filters and input files for whole run.
+*/
+type geoDB struct {
+	*geoip2.Reader
+
+	mu    sync.RWMutex
+	cache map[netip.Addr]geoRecord
+}
+
+var geoDBs = struct {
+	sync.Mutex
+	dbs map[string]*geoDB
+}{dbs: make(map[string]*geoDB)}
+
+// openGeoDB opens maxmind database only once per path
+func openGeoDB(path string) (*geoDB, error) {
+	geoDBs.Lock()
+	defer geoDBs.Unlock()
+	if db, ok := geoDBs.dbs[path]; ok {
+		return db, nil
+	}
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	db := &geoDB{Reader: reader, cache: make(map[netip.Addr]geoRecord)}
+	geoDBs.dbs[path] = db
+	return db, nil
+}
+
+// lookup returns cached record or queries database, false means that lookup failed
+func (g *geoDB) lookup(addr netip.Addr) (geoRecord, bool) {
+	g.mu.RLock()
+	rec, ok := g.cache[addr]
+	g.mu.RUnlock()
+	if ok {
+		return rec, true
+	}
+	// reader is safe for concurrent use, only cache needs the lock
+	resp, err := g.City(net.IP(addr.AsSlice()))
+	if err != nil {
+		return geoRecord{}, false
+	}
+	rec = geoRecord{
+		Country:   resp.Country.IsoCode,
+		Continent: resp.Continent.Code,
+		City:      strings.ToLower(resp.City.Names["en"]),
+		CityID:    resp.City.GeoNameID,
+	}
+	g.mu.Lock()
+	if len(g.cache) >= geoCacheSize {
+		g.cache = make(map[netip.Addr]geoRecord)
+	}
+	g.cache[addr] = rec
+	g.mu.Unlock()
+	return rec, true
+}
+
+/*
+ConditionGeo matches packet IP addresses by country, continent or city. Countries and
+continents use ISO codes such as DE or EU, cities are matched by english name or geoname ID.
+*/
+type ConditionGeo struct {
+	Kind   FilterKind
+	Values map[string]bool
+	DB     *geoDB
+
+	lookupErrs uint64
+}
+
+func (cg *ConditionGeo) Match(pkt gopacket.Packet) bool {
+	src, dst := cg.MatchSides(pkt)
+	return src || dst
+}
+
+func (cg *ConditionGeo) MatchSides(pkt gopacket.Packet) (bool, bool) {
+	if n := pkt.NetworkLayer(); n != nil {
+		return cg.match(n.NetworkFlow().Src()), cg.match(n.NetworkFlow().Dst())
+	}
+	return false, false
+}
+
+func (cg *ConditionGeo) match(ep gopacket.Endpoint) bool {
+	addr, ok := netip.AddrFromSlice(ep.Raw())
+	if !ok {
+		return false
+	}
+	rec, ok := cg.DB.lookup(addr)
+	if !ok {
+		atomic.AddUint64(&cg.lookupErrs, 1)
+		return false
+	}
+	switch cg.Kind {
+	case FilterKindCountry:
+		return cg.Values[rec.Country]
+	case FilterKindContinent:
+		return cg.Values[rec.Continent]
+	case FilterKindCity:
+		return cg.Values[rec.City] || (rec.CityID > 0 && cg.Values[strconv.Itoa(int(rec.CityID))])
+	}
+	return false
+}
+
+// LookupErrs returns number of failed database lookups
+func (cg *ConditionGeo) LookupErrs() int {
+	return int(atomic.LoadUint64(&cg.lookupErrs))
+}
+
+// NewConditionGeo builds a country, continent or city matcher from maxmind database
+func NewConditionGeo(path string, kind FilterKind, values []string) (*ConditionGeo, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no values to parse into %s condition", kind)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%s matcher needs maxmind country or city database", kind)
+	}
+	db, err := openGeoDB(path)
+	if err != nil {
+		return nil, err
+	}
+	cg := &ConditionGeo{Kind: kind, DB: db, Values: make(map[string]bool, len(values))}
+	for _, val := range values {
+		switch kind {
+		case FilterKindCountry, FilterKindContinent:
+			if len(val) != 2 {
+				return nil, fmt.Errorf("%s is not a 2 letter %s code", val, kind)
+			}
+			cg.Values[strings.ToUpper(val)] = true
+		case FilterKindCity:
+			cg.Values[strings.ToLower(val)] = true
+		default:
+			return nil, errors.New("unsupported geo condition kind")
+		}
+	}
+	return cg, nil
+}
@@ -0,0 +1,49 @@
+package filter
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestConditionGeoCached(t *testing.T) {
+	// lookups are served from cache, so no database is needed
+	db := &geoDB{cache: map[netip.Addr]geoRecord{
+		netip.MustParseAddr("10.0.0.1"): {Country: "DE", Continent: "EU", City: "berlin", CityID: 2950159},
+		netip.MustParseAddr("10.0.0.2"): {Country: "US", Continent: "NA"},
+	}}
+	pkt := buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1234, 53)
+	testCases := []struct {
+		kind  FilterKind
+		value string
+		match bool
+	}{
+		{kind: FilterKindCountry, value: "DE", match: true},
+		{kind: FilterKindCountry, value: "FR"},
+		{kind: FilterKindContinent, value: "NA", match: true},
+		{kind: FilterKindCity, value: "berlin", match: true},
+		{kind: FilterKindCity, value: "2950159", match: true},
+		{kind: FilterKindCity, value: "paris"},
+	}
+	for _, tc := range testCases {
+		cg := &ConditionGeo{Kind: tc.kind, DB: db, Values: map[string]bool{tc.value: true}}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if cg.Match(pkt) != tc.match {
+						t.Errorf("%s %s: expected match %t", tc.kind, tc.value, tc.match)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if cg.LookupErrs() != 0 {
+			t.Fatalf("%s %s: %d lookup errors", tc.kind, tc.value, cg.LookupErrs())
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket"
+)
+
+type trieNode struct {
+	children [2]int32
+	terminal bool
+}
+
+/*
+prefixTrie is a binary trie over address bits. Nodes are kept in a single slice and refer to
+children by index, so large lists do not produce millions of small allocations. Index 0 is
+root, which also serves as nil child since root can never be a child.
+*/
+type prefixTrie struct {
+	nodes []trieNode
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{nodes: make([]trieNode, 1)}
+}
+
+func (t *prefixTrie) insert(addr []byte, bits int) {
+	var current int32
+	for i := 0; i < bits; i++ {
+		if t.nodes[current].terminal {
+			// shorter prefix already covers this one
+			return
+		}
+		bit := addr[i/8] >> (7 - uint(i%8)) & 1
+		next := t.nodes[current].children[bit]
+		if next == 0 {
+			t.nodes = append(t.nodes, trieNode{})
+			next = int32(len(t.nodes) - 1)
+			t.nodes[current].children[bit] = next
+		}
+		current = next
+	}
+	t.nodes[current].terminal = true
+	// covered longer prefixes are no longer reachable
+	t.nodes[current].children = [2]int32{}
+}
+
+func (t *prefixTrie) contains(addr []byte) bool {
+	var current int32
+	for i := 0; i < len(addr)*8; i++ {
+		if t.nodes[current].terminal {
+			return true
+		}
+		bit := addr[i/8] >> (7 - uint(i%8)) & 1
+		next := t.nodes[current].children[bit]
+		if next == 0 {
+			return false
+		}
+		current = next
+	}
+	return t.nodes[current].terminal
+}
+
+/*
+ConditionIPList matches packet IP addresses against large lists of addresses and networks,
+loaded from files. Lookups take at most address length steps regardless of list size.
+*/
+type ConditionIPList struct {
+	v4, v6 *prefixTrie
+	Count  int
+}
+
+func (ci ConditionIPList) Match(pkt gopacket.Packet) bool {
+	src, dst := ci.MatchSides(pkt)
+	return src || dst
+}
+
+func (ci ConditionIPList) MatchSides(pkt gopacket.Packet) (bool, bool) {
+	if n := pkt.NetworkLayer(); n != nil {
+		return ci.match(n.NetworkFlow().Src().Raw()), ci.match(n.NetworkFlow().Dst().Raw())
+	}
+	return false, false
+}
+
+func (ci ConditionIPList) match(addr []byte) bool {
+	switch len(addr) {
+	case 4:
+		return ci.v4.contains(addr)
+	case 16:
+		return ci.v6.contains(addr)
+	}
+	return false
+}
+
+// Add inserts a single address or CIDR network into list
+func (ci *ConditionIPList) Add(raw string) error {
+	var prefix netip.Prefix
+	if strings.Contains(raw, "/") {
+		p, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return err
+		}
+		prefix = p.Masked()
+	} else {
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			return err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	if addr.Is4() {
+		ci.v4.insert(addr.AsSlice(), bits)
+	} else {
+		ci.v6.insert(addr.AsSlice(), bits)
+	}
+	ci.Count++
+	return nil
+}
+
+/*
+NewConditionIPList loads IP list files into a Matcher. Each line holds an address or CIDR
+network, optionally as first column of CSV. Empty lines and # comments are skipped, as is
+first entry if it does not parse, so CSV headers are tolerated.
+*/
+func NewConditionIPList(paths []string) (*ConditionIPList, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no ip list files to load")
+	}
+	ci := &ConditionIPList{v4: newPrefixTrie(), v6: newPrefixTrie()}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = ci.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	if ci.Count == 0 {
+		return nil, errors.New("ip list files hold no addresses")
+	}
+	return ci, nil
+}
+
+func (ci *ConditionIPList) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var line, entries int
+	for scanner.Scan() {
+		line++
+		raw := scanner.Text()
+		if idx := strings.Index(raw, "#"); idx >= 0 {
+			raw = raw[:idx]
+		}
+		if idx := strings.IndexAny(raw, ",;\t"); idx >= 0 {
+			raw = raw[:idx]
+		}
+		raw = strings.Trim(strings.TrimSpace(raw), `"'`)
+		if raw == "" {
+			continue
+		}
+		entries++
+		if err := ci.Add(raw); err != nil {
+			if entries == 1 {
+				continue
+			}
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,46 @@
+package filter
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIPList(t *testing.T) {
+	ci := &ConditionIPList{v4: newPrefixTrie(), v6: newPrefixTrie()}
+	err := ci.load(strings.NewReader(`ip,source,comment
+# threat intel export
+10.0.0.0/8,feed-a,private
+192.168.1.10,feed-b
+"203.0.113.0/24",feed-c
+2001:db8::/32 # documentation
+::ffff:198.51.100.0/120
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Count != 5 {
+		t.Fatalf("expected 5 entries, got %d", ci.Count)
+	}
+	cases := map[string]bool{
+		"10.1.2.3":        true,
+		"11.0.0.1":        false,
+		"192.168.1.10":    true,
+		"192.168.1.11":    false,
+		"203.0.113.200":   true,
+		"198.51.100.7":    true,
+		"2001:db8:1::1":   true,
+		"2001:db9::1":     false,
+		"0.0.0.0":         false,
+		"255.255.255.255": false,
+	}
+	for raw, want := range cases {
+		addr := netip.MustParseAddr(raw)
+		if got := ci.match(addr.AsSlice()); got != want {
+			t.Fatalf("%s: got %t, expected %t", raw, got, want)
+		}
+	}
+	if err := ci.load(strings.NewReader("10.0.0.1\nnot-an-ip\n")); err == nil {
+		t.Fatal("invalid entry after first line should fail")
+	}
+}
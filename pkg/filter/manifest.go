@@ -0,0 +1,101 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+)
+
+// ManifestFile is name of manifest written into each filter output directory
+const ManifestFile = "manifest.json"
+
+/*
+ManifestEntry describes a single output file for chain of custody. Sources lists input files
+that contributed packets, which can be more than one for merged and per-flow outputs.
+*/
+type ManifestEntry struct {
+	Sources []string  `json:"sources"`
+	Output  string    `json:"output"`
+	Matched int       `json:"matched"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	SHA256  string    `json:"sha256"`
+}
+
+func (m *ManifestEntry) add(source string, ts time.Time) {
+	m.Matched++
+	if m.First.IsZero() || ts.Before(m.First) {
+		m.First = ts
+	}
+	if ts.After(m.Last) {
+		m.Last = ts
+	}
+	for _, s := range m.Sources {
+		if s == source {
+			return
+		}
+	}
+	m.Sources = append(m.Sources, source)
+}
+
+// NewManifestEntries describes files written by rotating writer from given sources
+func NewManifestEntries(sources []string, files []rotate.File) []ManifestEntry {
+	entries := make([]ManifestEntry, 0, len(files))
+	for _, f := range files {
+		entries = append(entries, ManifestEntry{
+			Sources: sources,
+			Output:  f.Path,
+			Matched: f.Packets,
+			First:   f.Beginning,
+			Last:    f.End,
+			SHA256:  f.SHA256,
+		})
+	}
+	return entries
+}
+
+// WriteManifest stores entries sorted by output path as JSON into manifest file in dir
+func WriteManifest(dir string, entries []ManifestEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Output < entries[j].Output })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), data, 0640)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
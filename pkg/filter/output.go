@@ -0,0 +1,257 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+type OutputMode int
+
+const (
+	// OutputModeInput writes a separate output file for each input file
+	OutputModeInput OutputMode = iota
+	// OutputModeMerged writes a single time ordered output per filter across all inputs
+	OutputModeMerged
+	// OutputModeFlow writes a separate output file for each flow
+	OutputModeFlow
+)
+
+func (m OutputMode) String() string {
+	switch m {
+	case OutputModeMerged:
+		return "merged"
+	case OutputModeFlow:
+		return "flow"
+	default:
+		return "input"
+	}
+}
+
+func NewOutputMode(raw string) (OutputMode, error) {
+	switch raw {
+	case "", OutputModeInput.String():
+		return OutputModeInput, nil
+	case OutputModeMerged.String():
+		return OutputModeMerged, nil
+	case OutputModeFlow.String():
+		return OutputModeFlow, nil
+	default:
+		return OutputModeInput, fmt.Errorf("invalid output mode %s, use one of input, merged, flow", raw)
+	}
+}
+
+// PacketWriter stores matched packets, allowing targets to use custom output layouts
+type PacketWriter interface {
+	// WritePacket stores a packet read from source input file with given link type
+	WritePacket(pkt gopacket.Packet, linkType layers.LinkType, source string) error
+}
+
+// DefaultFlowMaxOpen is default number of per-flow files kept open at once
+const DefaultFlowMaxOpen = 256
+
+/*
+FlowWriter writes each flow into a separate pcap file named by its 5-tuple. Only MaxOpen files
+are kept open, least recently used one is closed when limit is reached and appended to if
+flow shows up again. Flows can span many inputs, so a single FlowWriter is used for all inputs
+of a filter. Packets are appended as written, so inputs must be fed one at a time in time
+order for flow files to be time ordered. All packets must share same link type.
+*/
+type FlowWriter struct {
+	Dir      string
+	Compress bool
+	MaxOpen  int
+
+	mu       sync.Mutex
+	linkType layers.LinkType
+	open     map[string]*list.Element
+	lru      *list.List
+	created  map[string]*ManifestEntry
+}
+
+func NewFlowWriter(dir string, compress bool, maxOpen int) *FlowWriter {
+	if maxOpen < 1 {
+		maxOpen = DefaultFlowMaxOpen
+	}
+	return &FlowWriter{
+		Dir:      dir,
+		Compress: compress,
+		MaxOpen:  maxOpen,
+		open:     make(map[string]*list.Element),
+		lru:      list.New(),
+		created:  make(map[string]*ManifestEntry),
+	}
+}
+
+type flowFile struct {
+	name   string
+	file   *os.File
+	buf    *bufio.Writer
+	gz     *gzip.Writer
+	writer *pcapgo.Writer
+}
+
+func (ff *flowFile) close() error {
+	defer ff.file.Close()
+	if ff.gz != nil {
+		if err := ff.gz.Close(); err != nil {
+			return err
+		}
+	}
+	return ff.buf.Flush()
+}
+
+func (fw *FlowWriter) WritePacket(pkt gopacket.Packet, linkType layers.LinkType, source string) error {
+	name := FlowFileName(pkt)
+	if fw.Compress {
+		name += ".gz"
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.linkType == layers.LinkTypeNull {
+		fw.linkType = linkType
+	} else if fw.linkType != linkType {
+		return fmt.Errorf("%s link type %s does not match %s of earlier inputs", source, linkType, fw.linkType)
+	}
+	elem, ok := fw.open[name]
+	if ok {
+		fw.lru.MoveToFront(elem)
+	} else {
+		if fw.lru.Len() >= fw.MaxOpen {
+			if err := fw.evict(); err != nil {
+				return err
+			}
+		}
+		ff, err := fw.openFile(name, linkType)
+		if err != nil {
+			return err
+		}
+		elem = fw.lru.PushFront(ff)
+		fw.open[name] = elem
+	}
+	ci := pkt.Metadata().CaptureInfo
+	if err := elem.Value.(*flowFile).writer.WritePacket(ci, pkt.Data()); err != nil {
+		return err
+	}
+	fw.created[name].add(source, ci.Timestamp)
+	return nil
+}
+
+// Close flushes and closes all open flow files
+func (fw *FlowWriter) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	var err error
+	for fw.lru.Len() > 0 {
+		if cerr := fw.evict(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Files returns number of distinct flow files written
+func (fw *FlowWriter) Files() int {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return len(fw.created)
+}
+
+// Manifest describes all written flow files, output digests are computed so call after Close
+func (fw *FlowWriter) Manifest() ([]ManifestEntry, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	entries := make([]ManifestEntry, 0, len(fw.created))
+	for _, entry := range fw.created {
+		digest, err := fileSHA256(entry.Output)
+		if err != nil {
+			return nil, err
+		}
+		entry.SHA256 = digest
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+func (fw *FlowWriter) evict() error {
+	elem := fw.lru.Back()
+	ff := fw.lru.Remove(elem).(*flowFile)
+	delete(fw.open, ff.name)
+	return ff.close()
+}
+
+// openFile creates flow file on first use, later opens append to it without a new file header
+func (fw *FlowWriter) openFile(name string, linkType layers.LinkType) (*flowFile, error) {
+	path := filepath.Join(fw.Dir, name)
+	_, appending := fw.created[name]
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appending {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("flow file create: %s", err)
+	}
+	ff := &flowFile{name: name, file: f, buf: bufio.NewWriterSize(f, 1024*4)}
+	var out io.Writer = ff.buf
+	if fw.Compress {
+		// concatenated gzip members form a valid stream
+		ff.gz = gzip.NewWriter(ff.buf)
+		out = ff.gz
+	}
+	ff.writer = pcapgo.NewWriter(out)
+	if !appending {
+		if err := ff.writer.WriteFileHeader(1024*64, linkType); err != nil {
+			f.Close()
+			return nil, err
+		}
+		fw.created[name] = &ManifestEntry{Output: path, Sources: make([]string, 0, 1)}
+	}
+	return ff, nil
+}
+
+/*
+FlowFileName builds pcap file name from direction independent flow 5-tuple, such as
+tcp_10.0.0.1_1111_10.0.0.2_80.pcap. Packets without transport ports use ip as protocol and
+packets without network layer go to other.pcap.
+*/
+func FlowFileName(pkt gopacket.Packet) string {
+	key, ok := NewFlowKey(pkt)
+	if !ok {
+		return "other.pcap"
+	}
+	src, dst := key.Network.Endpoints()
+	if key.Transport.EndpointType() == gopacket.EndpointInvalid {
+		return fmt.Sprintf("ip_%s_%s.pcap", src, dst)
+	}
+	sport, dport := key.Transport.Endpoints()
+	return fmt.Sprintf("%s_%s_%s_%s_%s.pcap",
+		strings.ToLower(key.Transport.EndpointType().String()), src, sport, dst, dport)
+}
@@ -0,0 +1,87 @@
+package filter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestFlowWriter(t *testing.T) {
+	a, b := net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 1}
+	pkts := []gopacket.Packet{
+		buildPacketUDP(a, b, 53, 1111),
+		buildPacketUDP(b, a, 1111, 53),
+		buildPacketUDP(a, b, 53, 2222),
+		buildPacketUDP(a, b, 53, 1111),
+	}
+	for i, pkt := range pkts {
+		pkt.Metadata().CaptureInfo = gopacket.CaptureInfo{
+			Timestamp:     time.Unix(1600000000+int64(i), 0),
+			CaptureLength: len(pkt.Data()),
+			Length:        len(pkt.Data()),
+		}
+	}
+	if name := FlowFileName(pkts[0]); name != "udp_10.0.0.1_1111_10.0.0.2_53.pcap" {
+		t.Fatalf("unexpected flow file name %s", name)
+	}
+
+	dir := t.TempDir()
+	// single open file forces eviction and append on every flow switch
+	fw := NewFlowWriter(dir, false, 1)
+	for _, pkt := range pkts {
+		if err := fw.WritePacket(pkt, layers.LinkTypeEthernet, "test.pcap"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.WritePacket(pkts[0], layers.LinkTypeRaw, "raw.pcap"); err == nil {
+		t.Fatal("packet with other link type should be rejected")
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fw.Files() != 2 {
+		t.Fatalf("expected 2 flow files, got %d", fw.Files())
+	}
+
+	entries, err := fw.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if len(e.Sources) != 1 || e.Sources[0] != "test.pcap" || e.SHA256 == "" || e.First.After(e.Last) {
+			t.Fatalf("invalid manifest entry %+v", e)
+		}
+	}
+
+	cases := map[string]int{
+		"udp_10.0.0.1_1111_10.0.0.2_53.pcap": 3,
+		"udp_10.0.0.1_2222_10.0.0.2_53.pcap": 1,
+	}
+	for name, expected := range cases {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := pcapgo.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		for {
+			if _, _, err := r.ReadPacketData(); err != nil {
+				break
+			}
+			count++
+		}
+		f.Close()
+		if count != expected {
+			t.Fatalf("%s: expected %d packets, got %d", name, expected, count)
+		}
+	}
+}
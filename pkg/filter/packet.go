@@ -17,42 +17,76 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package filter
 
 import (
-	"errors"
+	"encoding/binary"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
-func DecapGREandERSPAN(pkt gopacket.Packet, maxdepth int) (gopacket.Packet, error) {
-	var startLayer int
-loop:
-	for i, layer := range pkt.Layers() {
-		if maxdepth > 0 && i+1 == maxdepth {
-			// this can be a good performance optimization to only loop over N posterior layers
-			break loop
-		}
-		switch layer.LayerType() {
-		case layers.LayerTypeGRE:
-			startLayer = i
-		case layers.LayerTypeERSPANII:
-			startLayer = i
-		}
+/*
+StripVLANandMPLS removes 802.1Q / QinQ tags and MPLS label stack from ethernet frames. MPLS is
+only removed when payload is IPv4 or IPv6, as other payloads can not be identified without
+signaling info. Packets without ethernet header are returned as-is.
+*/
+func StripVLANandMPLS(pkt gopacket.Packet, vlan, mpls bool) gopacket.Packet {
+	data := pkt.Data()
+	if !vlan && !mpls || len(data) < 14 || pkt.LinkLayer() == nil ||
+		pkt.LinkLayer().LayerType() != layers.LayerTypeEthernet {
+		return pkt
 	}
-	// Did not find any tunnel layers, assume no decap nor custom filtering is needed
-	if startLayer == 0 {
-		return pkt, nil
+	// offset of ethertype field
+	offset := 12
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+	etherType := layers.EthernetType(binary.BigEndian.Uint16(data[offset:]))
+
+	for isVLAN(etherType) && len(data) >= offset+6 {
+		if !vlan {
+			out = append(out, data[offset:offset+4]...)
+		}
+		offset += 4
+		etherType = layers.EthernetType(binary.BigEndian.Uint16(data[offset:]))
 	}
-	if len(pkt.Layers()) <= startLayer {
-		return pkt, errors.New("layer len mismatch")
+
+	if mpls && isMPLS(etherType) {
+		end := offset + 2
+		for end+4 <= len(data) {
+			bottom := data[end+2]&0x01 == 1
+			end += 4
+			if bottom {
+				break
+			}
+		}
+		if end < len(data) {
+			switch data[end] >> 4 {
+			case 4:
+				etherType = layers.EthernetTypeIPv4
+				offset = end - 2
+			case 6:
+				etherType = layers.EthernetTypeIPv6
+				offset = end - 2
+			}
+		}
 	}
-	inner := gopacket.NewPacket(
-		pkt.Layers()[startLayer].LayerPayload(),
-		pkt.Layers()[startLayer+1].LayerType(),
-		gopacket.Lazy,
-	)
-
-	if inner == nil || inner.NetworkLayer() == nil {
-		return pkt, errors.New("unable to build inner packet")
+	if offset == 12 {
+		return pkt
 	}
-	return inner, nil
+	out = binary.BigEndian.AppendUint16(out, uint16(etherType))
+	out = append(out, data[offset+2:]...)
+
+	stripped := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+	md := stripped.Metadata()
+	md.CaptureInfo = pkt.Metadata().CaptureInfo
+	md.CaptureLength = len(out)
+	md.Length = pkt.Metadata().Length - (len(data) - len(out))
+	return stripped
+}
+
+// isVLAN covers tags decoded as Dot1Q, so stripping agrees with vlan condition
+func isVLAN(t layers.EthernetType) bool {
+	return t == layers.EthernetTypeDot1Q || t == layers.EthernetTypeQinQ
+}
+
+func isMPLS(t layers.EthernetType) bool {
+	return t == layers.EthernetTypeMPLSUnicast || t == layers.EthernetTypeMPLSMulticast
 }
@@ -0,0 +1,263 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ConditionProto matches IP protocol numbers, IPv6 extension headers are skipped
+type ConditionProto map[layers.IPProtocol]bool
+
+func (cp ConditionProto) Match(pkt gopacket.Packet) bool {
+	for _, layer := range pkt.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			if cp[l.Protocol] {
+				return true
+			}
+		case *layers.IPv6:
+			if cp[l.NextHeader] {
+				return true
+			}
+		case *layers.IPv6HopByHop:
+			if cp[l.NextHeader] {
+				return true
+			}
+		case *layers.IPv6Routing:
+			if cp[l.NextHeader] {
+				return true
+			}
+		case *layers.IPv6Fragment:
+			if cp[l.NextHeader] {
+				return true
+			}
+		case *layers.IPv6Destination:
+			if cp[l.NextHeader] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewConditionProto parses protocol numbers or names such as tcp, udp, icmp or gre
+func NewConditionProto(protos []string) (ConditionProto, error) {
+	if len(protos) == 0 {
+		return nil, errors.New("no protocols to parse into condition")
+	}
+	cp := make(ConditionProto)
+	for _, raw := range protos {
+		proto, err := parseIPProtocol(raw)
+		if err != nil {
+			return nil, err
+		}
+		cp[proto] = true
+	}
+	return cp, nil
+}
+
+func parseIPProtocol(raw string) (layers.IPProtocol, error) {
+	if num, err := strconv.ParseUint(raw, 10, 8); err == nil {
+		return layers.IPProtocol(num), nil
+	}
+	name := strings.ToLower(raw)
+	switch name {
+	case "icmp":
+		return layers.IPProtocolICMPv4, nil
+	case "icmp6":
+		return layers.IPProtocolICMPv6, nil
+	}
+	for i := 0; i < 256; i++ {
+		if strings.ToLower(layers.IPProtocol(i).String()) == name {
+			return layers.IPProtocol(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown IP protocol %s", raw)
+}
+
+type icmpTypeCode struct {
+	typ     uint8
+	code    uint8
+	anyCode bool
+}
+
+// ConditionICMP matches ICMP or ICMPv6 type, and optionally code
+type ConditionICMP struct {
+	V6    bool
+	Types []icmpTypeCode
+}
+
+func (ci ConditionICMP) Match(pkt gopacket.Packet) bool {
+	var typ, code uint8
+	if ci.V6 {
+		l, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+		if !ok {
+			return false
+		}
+		typ, code = l.TypeCode.Type(), l.TypeCode.Code()
+	} else {
+		l, ok := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if !ok {
+			return false
+		}
+		typ, code = l.TypeCode.Type(), l.TypeCode.Code()
+	}
+	for _, tc := range ci.Types {
+		if tc.typ == typ && (tc.anyCode || tc.code == code) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewConditionICMP parses a list of <type> or <type>/<code> values into a Matcher
+func NewConditionICMP(values []string, v6 bool) (*ConditionICMP, error) {
+	if len(values) == 0 {
+		return nil, errors.New("no icmp types to parse into condition")
+	}
+	ci := &ConditionICMP{V6: v6, Types: make([]icmpTypeCode, 0, len(values))}
+	for _, raw := range values {
+		bits := strings.Split(raw, "/")
+		if len(bits) > 2 {
+			return nil, fmt.Errorf("%s not valid icmp format, should be <type>[/<code>]", raw)
+		}
+		typ, err := strconv.ParseUint(bits[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", raw, err)
+		}
+		tc := icmpTypeCode{typ: uint8(typ), anyCode: true}
+		if len(bits) == 2 {
+			code, err := strconv.ParseUint(bits[1], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", raw, err)
+			}
+			tc.code = uint8(code)
+			tc.anyCode = false
+		}
+		ci.Types = append(ci.Types, tc)
+	}
+	return ci, nil
+}
+
+type tcpFlags uint16
+
+const (
+	tcpFlagFIN tcpFlags = 1 << iota
+	tcpFlagSYN
+	tcpFlagRST
+	tcpFlagPSH
+	tcpFlagACK
+	tcpFlagURG
+	tcpFlagECE
+	tcpFlagCWR
+	tcpFlagNS
+)
+
+var tcpFlagNames = map[string]tcpFlags{
+	"fin": tcpFlagFIN,
+	"syn": tcpFlagSYN,
+	"rst": tcpFlagRST,
+	"psh": tcpFlagPSH,
+	"ack": tcpFlagACK,
+	"urg": tcpFlagURG,
+	"ece": tcpFlagECE,
+	"cwr": tcpFlagCWR,
+	"ns":  tcpFlagNS,
+}
+
+func newTCPFlags(l *layers.TCP) tcpFlags {
+	var f tcpFlags
+	for _, item := range []struct {
+		set  bool
+		flag tcpFlags
+	}{
+		{l.FIN, tcpFlagFIN},
+		{l.SYN, tcpFlagSYN},
+		{l.RST, tcpFlagRST},
+		{l.PSH, tcpFlagPSH},
+		{l.ACK, tcpFlagACK},
+		{l.URG, tcpFlagURG},
+		{l.ECE, tcpFlagECE},
+		{l.CWR, tcpFlagCWR},
+		{l.NS, tcpFlagNS},
+	} {
+		if item.set {
+			f |= item.flag
+		}
+	}
+	return f
+}
+
+type tcpFlagSpec struct {
+	set, unset tcpFlags
+}
+
+/*
+ConditionTCPFlags matches TCP flag combinations. Each spec lists flags that must be set and,
+prefixed with !, flags that must be unset. Packet matches if any spec is satisfied.
+*/
+type ConditionTCPFlags []tcpFlagSpec
+
+func (ct ConditionTCPFlags) Match(pkt gopacket.Packet) bool {
+	l, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	flags := newTCPFlags(l)
+	for _, spec := range ct {
+		if flags&spec.set == spec.set && flags&spec.unset == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NewConditionTCPFlags parses flag specs such as "syn,!ack" into a Matcher
+func NewConditionTCPFlags(specs []string) (ConditionTCPFlags, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no tcp flags to parse into condition")
+	}
+	ct := make(ConditionTCPFlags, 0, len(specs))
+	for _, raw := range specs {
+		var spec tcpFlagSpec
+		for _, name := range strings.Split(raw, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			negate := strings.HasPrefix(name, "!")
+			flag, ok := tcpFlagNames[strings.TrimPrefix(name, "!")]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown tcp flag %s", raw, name)
+			}
+			if negate {
+				spec.unset |= flag
+			} else {
+				spec.set |= flag
+			}
+		}
+		if spec.set&spec.unset != 0 {
+			return nil, fmt.Errorf("%s: flag can not be both set and unset", raw)
+		}
+		ct = append(ct, spec)
+	}
+	return ct, nil
+}
@@ -0,0 +1,290 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// SummaryFile is name of summary written into each filter output directory
+const SummaryFile = "summary.json"
+
+/*
+CountingMatcher counts how many times a condition was evaluated and how many times it
+matched. Conditions after a failed one in a group are not evaluated, so counts of later
+conditions can be lower.
+*/
+type CountingMatcher struct {
+	M    Matcher
+	Path string
+	Kind string
+
+	evaluated uint64
+	hits      uint64
+	// shared receives counts of copies made by NewFlowScope
+	shared *CountingMatcher
+}
+
+func (cm *CountingMatcher) Match(pkt gopacket.Packet) bool {
+	counts := cm
+	if cm.shared != nil {
+		counts = cm.shared
+	}
+	atomic.AddUint64(&counts.evaluated, 1)
+	if cm.M.Match(pkt) {
+		atomic.AddUint64(&counts.hits, 1)
+		return true
+	}
+	return false
+}
+
+func (cm *CountingMatcher) withFreshFlows() (Matcher, bool) {
+	inner, ok := flowScope(cm.M)
+	if !ok {
+		return cm, false
+	}
+	shared := cm.shared
+	if shared == nil {
+		shared = cm
+	}
+	return &CountingMatcher{M: inner, Path: cm.Path, Kind: cm.Kind, shared: shared}, true
+}
+
+// ConditionStats holds counts of a single condition in filter config
+type ConditionStats struct {
+	Path      string `json:"path"`
+	Kind      string `json:"kind"`
+	Evaluated uint64 `json:"evaluated"`
+	Hits      uint64 `json:"hits"`
+}
+
+// ConditionHits collects counting matchers, ASN and geo conditions of a single filter
+type ConditionHits struct {
+	mu       sync.Mutex
+	counters []*CountingMatcher
+	asn      []*ConditionASN
+	geo      []*ConditionGeo
+}
+
+func (h *ConditionHits) wrap(m Matcher, item FilterItem, path string) Matcher {
+	kind := item.Kind
+	switch {
+	case item.Any != nil:
+		kind = "any"
+	case item.All != nil:
+		kind = "all"
+	case item.Not != nil:
+		kind = "not"
+	}
+	cm := &CountingMatcher{M: m, Path: path, Kind: kind}
+	h.mu.Lock()
+	h.counters = append(h.counters, cm)
+	h.mu.Unlock()
+	return cm
+}
+
+func (h *ConditionHits) addASN(ca *ConditionASN) {
+	h.mu.Lock()
+	h.asn = append(h.asn, ca)
+	h.mu.Unlock()
+}
+
+func (h *ConditionHits) addGeo(cg *ConditionGeo) {
+	h.mu.Lock()
+	h.geo = append(h.geo, cg)
+	h.mu.Unlock()
+}
+
+// Conditions returns counts in config order, parents before nested conditions
+func (h *ConditionHits) Conditions() []ConditionStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make([]ConditionStats, 0, len(h.counters))
+	for _, cm := range h.counters {
+		stats = append(stats, ConditionStats{
+			Path:      cm.Path,
+			Kind:      cm.Kind,
+			Evaluated: atomic.LoadUint64(&cm.evaluated),
+			Hits:      atomic.LoadUint64(&cm.hits),
+		})
+	}
+	// nested conditions are built before their parent, so order by path instead
+	sort.Slice(stats, func(i, j int) bool { return pathLess(stats[i].Path, stats[j].Path) })
+	return stats
+}
+
+// ASNErrs sums lookup and IP parse errors of all ASN conditions
+func (h *ConditionHits) ASNErrs() (int, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var lookup, parse int
+	for _, ca := range h.asn {
+		l, p := ca.Errs()
+		lookup += l
+		parse += p
+	}
+	return lookup, parse
+}
+
+// GeoErrs sums lookup errors of all country, continent and city conditions
+func (h *ConditionHits) GeoErrs() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var lookup int
+	for _, cg := range h.geo {
+		lookup += cg.LookupErrs()
+	}
+	return lookup
+}
+
+// pathLess compares condition paths with indexes as numbers, so conditions[2] is before conditions[10]
+func pathLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digits(a), digits(b)
+		if da > 0 && db > 0 {
+			na, _ := strconv.Atoi(a[:da])
+			nb, _ := strconv.Atoi(b[:db])
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func digits(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+/*
+Summary aggregates results of a single filter over all inputs. Read statistics such as
+packets and errors count whole inputs that were filtered, so they are shared by filters in
+single pass mode. Inputs completed in an interrupted run only contribute matched count and
+outputs. Inputs of failed tasks are listed separately and not counted in totals.
+*/
+type Summary struct {
+	Filter       string    `json:"filter"`
+	Inputs       int       `json:"inputs"`
+	Resumed      int       `json:"resumed"`
+	Packets      int       `json:"packets"`
+	Matched      int       `json:"matched"`
+	Skipped      int       `json:"skipped"`
+	Errors       int       `json:"errors"`
+	DecapErrors  int       `json:"decap_errors"`
+	Deduplicated int       `json:"deduplicated"`
+	DedupRatio   float64   `json:"dedup_ratio"`
+	FirstMatched time.Time `json:"first_matched"`
+	LastMatched  time.Time `json:"last_matched"`
+	OutputFiles  int       `json:"output_files"`
+	// OutputBytes is size of outputs on disk, after compression
+	OutputBytes int64 `json:"output_bytes"`
+
+	Conditions     []ConditionStats `json:"conditions"`
+	ASNLookupErrs  int              `json:"asn_lookup_errors"`
+	ASNIPParseErrs int              `json:"asn_ip_parse_errors"`
+	GeoLookupErrs  int              `json:"geo_lookup_errors"`
+
+	// FailedInputs could not be filtered, partial outputs other than per-flow files are removed
+	FailedInputs []string `json:"failed_inputs"`
+}
+
+// AddResult adds a completed task, target result belongs to summarized filter
+func (s *Summary) AddResult(fr *FilterResult, tr *TargetResult) {
+	s.Inputs++
+	s.Packets += fr.Count
+	s.Errors += fr.Errors
+	s.DecapErrors += fr.DecapErrors
+	s.Deduplicated += fr.Deduplicated
+	s.Matched += tr.Matched
+	s.Skipped += tr.Skipped
+	if s.Packets > 0 {
+		s.DedupRatio = float64(s.Deduplicated) / float64(s.Packets) * 100
+	}
+}
+
+// AddFailed records input of a task that failed
+func (s *Summary) AddFailed(input string) {
+	s.FailedInputs = append(s.FailedInputs, input)
+}
+
+// AddResumed adds a task loaded from checkpoint
+func (s *Summary) AddResumed(rec CheckpointRecord) {
+	s.Inputs++
+	s.Resumed++
+	s.Matched += rec.Matched
+}
+
+// AddOutputs takes matched time range and output sizes from final manifest entries
+func (s *Summary) AddOutputs(entries []ManifestEntry) {
+	for _, e := range entries {
+		s.OutputFiles++
+		if stat, err := os.Stat(e.Output); err == nil {
+			s.OutputBytes += stat.Size()
+		}
+		if !e.First.IsZero() && (s.FirstMatched.IsZero() || e.First.Before(s.FirstMatched)) {
+			s.FirstMatched = e.First
+		}
+		if e.Last.After(s.LastMatched) {
+			s.LastMatched = e.Last
+		}
+	}
+}
+
+// AddHits takes per condition counts, ASN and geo errors, nil is ignored
+func (s *Summary) AddHits(h *ConditionHits) {
+	if h == nil {
+		return
+	}
+	s.Conditions = h.Conditions()
+	s.ASNLookupErrs, s.ASNIPParseErrs = h.ASNErrs()
+	s.GeoLookupErrs = h.GeoErrs()
+}
+
+// WriteSummary stores summary as JSON into summary file in dir
+func WriteSummary(dir string, s Summary) error {
+	if s.Conditions == nil {
+		s.Conditions = []ConditionStats{}
+	}
+	if s.FailedInputs == nil {
+		s.FailedInputs = []string{}
+	}
+	sort.Strings(s.FailedInputs)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, SummaryFile), data, 0640)
+}
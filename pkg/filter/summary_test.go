@@ -0,0 +1,91 @@
+package filter
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestConditionHits(t *testing.T) {
+	var cfg CombinedConfig
+	if err := yaml.Unmarshal([]byte(`
+conditions:
+  - kind: port
+    match: [53/udp]
+  - any:
+      - kind: subnet
+        match: [10.0.0.0/8]
+      - kind: subnet
+        match: [172.16.0.0/12]
+`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	hits := &ConditionHits{}
+	m, err := NewCombinedMatcher(MatcherConfig{CombinedConfig: cfg, Hits: hits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Match(buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{8, 8, 8, 8}, 1234, 53))
+	m.Match(buildPacketUDP(net.IP{172, 16, 0, 1}, net.IP{8, 8, 8, 8}, 1234, 53))
+	m.Match(buildPacketUDP(net.IP{10, 0, 0, 1}, net.IP{8, 8, 8, 8}, 1234, 80))
+
+	expected := []ConditionStats{
+		{Path: "conditions[0]", Kind: "port", Evaluated: 3, Hits: 2},
+		{Path: "conditions[1]", Kind: "any", Evaluated: 2, Hits: 2},
+		{Path: "conditions[1].any[0]", Kind: "subnet", Evaluated: 2, Hits: 1},
+		{Path: "conditions[1].any[1]", Kind: "subnet", Evaluated: 1, Hits: 1},
+	}
+	stats := hits.Conditions()
+	if len(stats) != len(expected) {
+		t.Fatalf("expected %d conditions, got %+v", len(expected), stats)
+	}
+	for i := range expected {
+		if stats[i] != expected[i] {
+			t.Fatalf("condition %d: expected %+v, got %+v", i, expected[i], stats[i])
+		}
+	}
+	if !pathLess("conditions[2]", "conditions[10]") || pathLess("conditions[1].any[0]", "conditions[1]") {
+		t.Fatal("condition paths not ordered by index")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	s := Summary{Filter: "web"}
+	s.AddResult(&FilterResult{Count: 10, Deduplicated: 2}, &TargetResult{Matched: 4, Skipped: 4})
+	s.AddResult(&FilterResult{Count: 10, Errors: 1}, &TargetResult{Matched: 1, Skipped: 9})
+	s.AddResumed(CheckpointRecord{Matched: 3})
+	s.AddFailed("b.pcap")
+	s.AddFailed("a.pcap")
+	if s.Inputs != 3 || s.Resumed != 1 || s.Matched != 8 || s.Packets != 20 || s.Errors != 1 {
+		t.Fatalf("unexpected totals %+v", s)
+	}
+	if s.DedupRatio != 10 {
+		t.Fatalf("unexpected dedup ratio %f", s.DedupRatio)
+	}
+	hits := &ConditionHits{}
+	hits.addGeo(&ConditionGeo{lookupErrs: 3})
+	s.AddHits(hits)
+	if s.GeoLookupErrs != 3 {
+		t.Fatalf("unexpected geo lookup errors %d", s.GeoLookupErrs)
+	}
+
+	dir := t.TempDir()
+	if err := WriteSummary(dir, s); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, SummaryFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Summary
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.FailedInputs) != 2 || stored.FailedInputs[0] != "a.pcap" || stored.Inputs != 3 {
+		t.Fatalf("failed inputs should be stored sorted and not counted, got %+v", stored)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// anyDepth means tag can be anywhere in VLAN or MPLS stack
+const anyDepth = -1
+
+type tagValue struct {
+	id    uint32
+	depth int
+}
+
+/*
+ConditionTag matches 802.1Q / QinQ VLAN IDs or MPLS labels. Each value can be bound to a
+specific depth in tag stack, 0 being the outermost tag.
+*/
+type ConditionTag struct {
+	LayerType gopacket.LayerType
+	Values    []tagValue
+}
+
+func (ct ConditionTag) Match(pkt gopacket.Packet) bool {
+	var depth int
+	for _, layer := range pkt.Layers() {
+		if layer.LayerType() != ct.LayerType {
+			continue
+		}
+		var id uint32
+		switch l := layer.(type) {
+		case *layers.Dot1Q:
+			id = uint32(l.VLANIdentifier)
+		case *layers.MPLS:
+			id = l.Label
+		default:
+			continue
+		}
+		for _, v := range ct.Values {
+			if v.id == id && (v.depth == anyDepth || v.depth == depth) {
+				return true
+			}
+		}
+		depth++
+	}
+	return false
+}
+
+// NewConditionTag parses a list of <id> or <id>@<depth> values into a Matcher
+func NewConditionTag(values []string, layerType gopacket.LayerType) (*ConditionTag, error) {
+	if len(values) == 0 {
+		return nil, errors.New("no tag values to parse into condition")
+	}
+	maxID := uint64(4095)
+	if layerType == layers.LayerTypeMPLS {
+		maxID = 1<<20 - 1
+	}
+	ct := &ConditionTag{LayerType: layerType, Values: make([]tagValue, 0, len(values))}
+	for _, raw := range values {
+		bits := strings.Split(raw, "@")
+		if len(bits) > 2 {
+			return nil, fmt.Errorf("%s not valid tag format, should be <id>[@<depth>]", raw)
+		}
+		id, err := strconv.ParseUint(bits[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", raw, err)
+		}
+		if id > maxID {
+			return nil, fmt.Errorf("%s: id out of range, max is %d", raw, maxID)
+		}
+		v := tagValue{id: uint32(id), depth: anyDepth}
+		if len(bits) == 2 {
+			depth, err := strconv.Atoi(bits[1])
+			if err != nil || depth < 0 {
+				return nil, fmt.Errorf("%s: invalid depth", raw)
+			}
+			v.depth = depth
+		}
+		ct.Values = append(ct.Values, v)
+	}
+	return ct, nil
+}
@@ -0,0 +1,102 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func buildPacketTagged() gopacket.Packet {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 2},
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0xFF, 0xAA, 0xFA, 0xAA, 0xFF, 0xAA},
+			DstMAC:       net.HardwareAddr{0xBD, 0xBD, 0xBD, 0xBD, 0xBD, 0xAA},
+			EthernetType: layers.EthernetTypeDot1Q,
+		},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeMPLSUnicast},
+		&layers.MPLS{Label: 16, StackBottom: true, TTL: 64},
+		ip, udp, gopacket.Payload([]byte{1, 2, 3}),
+	); err != nil {
+		panic(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestConditionTag(t *testing.T) {
+	pkt := buildPacketTagged()
+	cases := []struct {
+		layer  gopacket.LayerType
+		values []string
+		want   bool
+	}{
+		{layers.LayerTypeDot1Q, []string{"200"}, true},
+		{layers.LayerTypeDot1Q, []string{"100@0"}, true},
+		{layers.LayerTypeDot1Q, []string{"100@1"}, false},
+		{layers.LayerTypeDot1Q, []string{"300"}, false},
+		{layers.LayerTypeMPLS, []string{"16@0"}, true},
+		{layers.LayerTypeMPLS, []string{"17"}, false},
+	}
+	for _, c := range cases {
+		m, err := NewConditionTag(c.values, c.layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(pkt); got != c.want {
+			t.Fatalf("%s %v: got %t, expected %t", c.layer, c.values, got, c.want)
+		}
+	}
+}
+
+func TestStripVLANandMPLS(t *testing.T) {
+	pkt := buildPacketTagged()
+	stripped := StripVLANandMPLS(pkt, true, true)
+	if stripped.Layer(layers.LayerTypeDot1Q) != nil || stripped.Layer(layers.LayerTypeMPLS) != nil {
+		t.Fatal("tags not stripped")
+	}
+	if len(stripped.Data()) != len(pkt.Data())-12 {
+		t.Fatalf("expected 12 bytes removed, got %d", len(pkt.Data())-len(stripped.Data()))
+	}
+	if udp, ok := stripped.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || udp.DstPort != 53 {
+		t.Fatal("inner packet not decoded after stripping")
+	}
+
+	vlanOnly := StripVLANandMPLS(pkt, true, false)
+	if vlanOnly.Layer(layers.LayerTypeDot1Q) != nil || vlanOnly.Layer(layers.LayerTypeMPLS) == nil {
+		t.Fatal("only vlan tags should be stripped")
+	}
+	mplsOnly := StripVLANandMPLS(pkt, false, true)
+	if mplsOnly.Layer(layers.LayerTypeDot1Q) == nil || mplsOnly.Layer(layers.LayerTypeMPLS) != nil {
+		t.Fatal("only mpls labels should be stripped")
+	}
+
+	// legacy 0x9100 tag is not decoded as vlan, so it is neither matched nor stripped
+	data := append([]byte{}, pkt.Data()...)
+	data[12], data[13] = 0x91, 0x00
+	legacy := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	if out := StripVLANandMPLS(legacy, true, false); out != legacy {
+		t.Fatal("0x9100 tag should be kept")
+	}
+	m, err := NewConditionTag([]string{"100"}, layers.LayerTypeDot1Q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Match(legacy) {
+		t.Fatal("0x9100 tag should not match vlan condition")
+	}
+}
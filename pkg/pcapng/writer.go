@@ -0,0 +1,142 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package pcapng
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// block types and option codes, see draft-ietf-opsawg-pcapng
+const (
+	blockSectionHeader   uint32 = 0x0A0D0D0A
+	blockInterface       uint32 = 0x00000001
+	blockEnhancedPacket  uint32 = 0x00000006
+	byteOrderMagic       uint32 = 0x1A2B3C4D
+	optEndOfOpt          uint16 = 0
+	optComment           uint16 = 1
+	optInterfaceTSResol  uint16 = 9
+	enhancedPacketHeader        = 28
+	// nanosecond timestamp resolution
+	tsResolution = 9
+)
+
+/*
+Writer writes packets into a pcapng stream with single section and single interface.
+Unlike pcapgo writer, each packet can carry a comment, which is shown by Wireshark and
+tshark. Timestamps are written with nanosecond resolution.
+*/
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter writes section header and interface description into w
+func NewWriter(w io.Writer, linkType layers.LinkType, snaplen uint32) (*Writer, error) {
+	nw := &Writer{w: w, buf: make([]byte, 0, 1024*64)}
+
+	shb := make([]byte, 0, 28)
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	// section length is not known in advance
+	shb = binary.LittleEndian.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF)
+	if err := nw.writeBlock(blockSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 0, 20)
+	idb = binary.LittleEndian.AppendUint16(idb, uint16(linkType))
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, snaplen)
+	idb = appendOption(idb, optInterfaceTSResol, []byte{tsResolution})
+	idb = appendOption(idb, optEndOfOpt, nil)
+	if err := nw.writeBlock(blockInterface, idb); err != nil {
+		return nil, err
+	}
+	return nw, nil
+}
+
+// WritePacket implements gopacket writer interface
+func (nw *Writer) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return nw.WritePacketComment(ci, data, "")
+}
+
+// WritePacketComment writes packet as enhanced packet block, empty comment is omitted
+func (nw *Writer) WritePacketComment(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	if ci.CaptureLength != len(data) {
+		return errors.New("capture length does not match data length")
+	}
+	if len(comment) > 0xFFFF {
+		return errors.New("packet comment too long")
+	}
+	ts := uint64(ci.Timestamp.UnixNano())
+	body := nw.buf[:0]
+	body = binary.LittleEndian.AppendUint32(body, 0)
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ci.CaptureLength))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ci.Length))
+	body = append(body, data...)
+	body = append(body, make([]byte, pad(len(data)))...)
+	if comment != "" {
+		body = appendOption(body, optComment, []byte(comment))
+		body = appendOption(body, optEndOfOpt, nil)
+	}
+	nw.buf = body
+	return nw.writeBlock(blockEnhancedPacket, body)
+}
+
+// BlockSize returns size of enhanced packet block for given packet and comment lengths
+func BlockSize(dataLen, commentLen int) int {
+	size := enhancedPacketHeader + 4 + dataLen + pad(dataLen)
+	if commentLen > 0 {
+		size += 4 + commentLen + pad(commentLen) + 4
+	}
+	return size
+}
+
+// writeBlock frames body with block type and total length, body must be 32 bit aligned
+func (nw *Writer) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(len(body) + 12)
+	var head [8]byte
+	binary.LittleEndian.PutUint32(head[:], blockType)
+	binary.LittleEndian.PutUint32(head[4:], total)
+	if _, err := nw.w.Write(head[:]); err != nil {
+		return err
+	}
+	if _, err := nw.w.Write(body); err != nil {
+		return err
+	}
+	_, err := nw.w.Write(head[4:])
+	return err
+}
+
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, code)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	return append(buf, make([]byte, pad(len(value)))...)
+}
+
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
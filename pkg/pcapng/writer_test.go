@@ -0,0 +1,58 @@
+package pcapng
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, layers.LinkTypeEthernet, 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := [][]byte{{1, 2, 3, 4, 5}, {6, 7, 8, 9, 10, 11, 12, 13}}
+	ts := time.Unix(1600000000, 123456789)
+	for i, data := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: ts.Add(time.Duration(i) * time.Second), CaptureLength: len(data), Length: len(data)}
+		comment := ""
+		if i == 0 {
+			comment = "vxlan 192.168.0.1->192.168.0.2 id=42"
+		}
+		before := buf.Len()
+		if err := w.WritePacketComment(ci, data, comment); err != nil {
+			t.Fatal(err)
+		}
+		if size := BlockSize(len(data), len(comment)); buf.Len()-before != size {
+			t.Fatalf("block size %d does not match written %d", size, buf.Len()-before)
+		}
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("id=42")) {
+		t.Fatal("packet comment not written")
+	}
+
+	r, err := pcapgo.NewNgReader(bytes.NewReader(buf.Bytes()), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeEthernet {
+		t.Fatalf("unexpected link type %s", r.LinkType())
+	}
+	for i, expected := range packets {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("packet %d data mismatch", i)
+		}
+		if !ci.Timestamp.Equal(ts.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("packet %d timestamp %s", i, ci.Timestamp)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/dedup"
+	"github.com/StamusNetworks/gophercap/pkg/filter"
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+)
+
+// DedupConfig holds params for deduplicating pcap files read in global timestamp order
+type DedupConfig struct {
+	Files []*Pcap
+
+	Output rotate.Config
+	// Duplicates receives dropped packets when template is set
+	Duplicates rotate.Config
+
+	Dedup dedup.WindowConfig
+	// Inner deduplicates on packets inside tunnels, output is not decapsulated
+	Inner bool
+
+	Ctx context.Context
+}
+
+/*
+Validate implements a standard interface for checking config struct validity and setting
+sane default values.
+*/
+func (c *DedupConfig) Validate() error {
+	if c.Ctx == nil {
+		return errors.New("missing dedup stopper context")
+	}
+	if len(c.Files) == 0 {
+		return errors.New("no input files to dedup")
+	}
+	return c.Dedup.Validate()
+}
+
+// DedupStats counts duplicates for a single input file, source or whole run
+type DedupStats struct {
+	Packets    int `json:"packets"`
+	Duplicates int `json:"duplicates"`
+	// Ratio is percentage of packets that were duplicates
+	Ratio float64 `json:"ratio"`
+}
+
+func (s *DedupStats) add(dup bool) {
+	s.Packets++
+	if dup {
+		s.Duplicates++
+	}
+}
+
+func (s *DedupStats) finish() {
+	if s.Packets > 0 {
+		s.Ratio = float64(s.Duplicates) / float64(s.Packets) * 100
+	}
+}
+
+/*
+DedupResult holds duplicate statistics. Sources are keyed by outer source MAC and VLAN IDs,
+so a SPAN port that doubles traffic stands out.
+*/
+type DedupResult struct {
+	DedupStats
+	Files   map[string]*DedupStats `json:"files"`
+	Sources map[string]*DedupStats `json:"sources"`
+
+	OutputFiles    []rotate.File `json:"output_files"`
+	DuplicateFiles []rotate.File `json:"duplicate_files"`
+}
+
+func (r *DedupResult) add(file, source string, dup bool) {
+	r.DedupStats.add(dup)
+	stats := func(m map[string]*DedupStats, key string) *DedupStats {
+		s, ok := m[key]
+		if !ok {
+			s = &DedupStats{}
+			m[key] = s
+		}
+		return s
+	}
+	stats(r.Files, file).add(dup)
+	stats(r.Sources, source).add(dup)
+}
+
+func (r *DedupResult) finish() {
+	r.DedupStats.finish()
+	for _, s := range r.Files {
+		s.finish()
+	}
+	for _, s := range r.Sources {
+		s.finish()
+	}
+}
+
+/*
+Dedup reads input files in global timestamp order, so duplicates are also found across files,
+and writes unique packets into output. Dropped packets are optionally written to a separate
+output for inspection.
+*/
+func Dedup(c DedupConfig) (*DedupResult, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	d, err := dedup.NewWindowDedup(c.Dedup)
+	if err != nil {
+		return nil, err
+	}
+	merger, err := NewMerger(c.Files)
+	if err != nil {
+		return nil, err
+	}
+	defer merger.Close()
+
+	res := &DedupResult{
+		Files:   make(map[string]*DedupStats),
+		Sources: make(map[string]*DedupStats),
+	}
+	output, err := newMergerWriter(merger, c.Output)
+	if err != nil {
+		return nil, err
+	}
+	var duplicates *rotate.Writer
+	if c.Duplicates.Template != "" {
+		if duplicates, err = newMergerWriter(merger, c.Duplicates); err != nil {
+			return nil, err
+		}
+	}
+	closeAll := func() error {
+		err := output.Close()
+		res.OutputFiles = output.Files()
+		if duplicates != nil {
+			if derr := duplicates.Close(); derr != nil && err == nil {
+				err = derr
+			}
+			res.DuplicateFiles = duplicates.Files()
+		}
+		res.finish()
+		return err
+	}
+
+	report := time.NewTicker(5 * time.Second)
+	defer report.Stop()
+
+loop:
+	for {
+		select {
+		case <-c.Ctx.Done():
+			break loop
+		case <-report.C:
+			logrus.WithFields(logrus.Fields{
+				"packets":    res.Packets,
+				"duplicates": res.Duplicates,
+			}).Info("deduplicating packets")
+		default:
+		}
+		data, ci, err := merger.ReadPacketData()
+		if err == io.EOF {
+			break loop
+		} else if err != nil {
+			closeAll()
+			return res, err
+		}
+		pkt := gopacket.NewPacket(data, merger.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		pkt.Metadata().CaptureInfo = ci
+		source := DedupSource(pkt)
+		if c.Inner {
+			// on error, outer levels that were removed are still kept
+			pkt, _, _ = filter.Decapsulate(pkt, -1)
+		}
+		dup := d.Drop(pkt)
+		res.add(merger.Source(), source, dup)
+
+		w := output
+		if dup {
+			if duplicates == nil {
+				continue loop
+			}
+			w = duplicates
+		}
+		if err := w.WritePacket(ci, data); err != nil {
+			closeAll()
+			return res, err
+		}
+	}
+	if err := closeAll(); err != nil {
+		return res, err
+	}
+	return res, c.Ctx.Err()
+}
+
+func newMergerWriter(merger *Merger, out rotate.Config) (*rotate.Writer, error) {
+	out.LinkType = merger.LinkType()
+	out.Snaplen = merger.Snaplen()
+	return rotate.NewWriter(out)
+}
+
+// DedupSource identifies capture source of packet by outer source MAC and VLAN IDs
+func DedupSource(pkt gopacket.Packet) string {
+	var source string
+loop:
+	for _, layer := range pkt.Layers() {
+		switch l := layer.(type) {
+		case *layers.Ethernet:
+			if source != "" {
+				// inner frame of a tunnel
+				break loop
+			}
+			source = l.SrcMAC.String()
+		case *layers.Dot1Q:
+			source += " vlan=" + strconv.Itoa(int(l.VLANIdentifier))
+		default:
+			break loop
+		}
+	}
+	if source == "" {
+		return "unknown"
+	}
+	return source
+}
@@ -0,0 +1,157 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/dedup"
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// withSrcMAC returns copy of ethernet frame sent from another mirror port
+func withSrcMAC(frame []byte, mac net.HardwareAddr) []byte {
+	out := append([]byte{}, frame...)
+	copy(out[6:12], mac)
+	return out
+}
+
+func testDedup(t *testing.T, data ...[]byte) (*DedupResult, string, []string) {
+	paths := writeTestPcaps(t, t.TempDir(), data...)
+	files, err := PeekPcaps(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	res, err := Dedup(DedupConfig{
+		Files:      files,
+		Output:     rotate.Config{Dir: out, Template: "dedup.pcap"},
+		Duplicates: rotate.Config{Dir: out, Template: "duplicates.pcap"},
+		Dedup:      dedup.WindowConfig{Window: 2 * time.Second},
+		Ctx:        context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, out, paths
+}
+
+func TestDedup(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	a, b := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	flows := [][]byte{
+		udpFrame(t, a, b, 40000, 53),
+		udpFrame(t, a, b, 40001, 53),
+		udpFrame(t, a, b, 40002, 53),
+		udpFrame(t, a, b, 40003, 53),
+	}
+	mirror := net.HardwareAddr{0, 1, 2, 3, 4, 7}
+	// second mirror port sees first and last flow 100ms later, its file is listed first
+	res, out, paths := testDedup(t,
+		pcapOf(t, ts.Add(100*time.Millisecond), 3*time.Second,
+			withSrcMAC(flows[0], mirror), withSrcMAC(flows[3], mirror)),
+		pcapOf(t, ts, time.Second, flows...),
+	)
+
+	if res.Packets != 6 || res.Duplicates != 2 {
+		t.Fatalf("%d packets with %d duplicates, expected 6 with 2", res.Packets, res.Duplicates)
+	}
+	files := map[string]DedupStats{
+		paths[0]: {Packets: 2, Duplicates: 2, Ratio: 100},
+		paths[1]: {Packets: 4},
+	}
+	for path, expected := range files {
+		if got := res.Files[path]; got == nil || *got != expected {
+			t.Fatalf("file %s: %+v, expected %+v", path, got, expected)
+		}
+	}
+	sources := map[string]DedupStats{
+		mirror.String():     {Packets: 2, Duplicates: 2, Ratio: 100},
+		"00:01:02:03:04:05": {Packets: 4},
+	}
+	if len(res.Sources) != len(sources) {
+		t.Fatalf("got %d sources, expected %d", len(res.Sources), len(sources))
+	}
+	for source, expected := range sources {
+		if got := res.Sources[source]; got == nil || *got != expected {
+			t.Fatalf("source %s: %+v, expected %+v", source, got, expected)
+		}
+	}
+
+	unique := readTestPcap(t, filepath.Join(out, "dedup.pcap"))
+	if len(unique) != len(flows) {
+		t.Fatalf("got %d unique packets, expected %d", len(unique), len(flows))
+	}
+	for i := range flows {
+		if !bytes.Equal(unique[i], flows[i]) {
+			t.Fatalf("unique packet %d is not from first mirror port in time order", i)
+		}
+	}
+	dups := readTestPcap(t, filepath.Join(out, "duplicates.pcap"))
+	if len(dups) != 2 || !bytes.Equal(dups[0], withSrcMAC(flows[0], mirror)) ||
+		!bytes.Equal(dups[1], withSrcMAC(flows[3], mirror)) {
+		t.Fatalf("duplicates output does not hold copies from second mirror port")
+	}
+	if len(res.OutputFiles) != 1 || res.OutputFiles[0].Packets != 4 ||
+		len(res.DuplicateFiles) != 1 || res.DuplicateFiles[0].Packets != 2 {
+		t.Fatalf("unexpected written files %+v and %+v", res.OutputFiles, res.DuplicateFiles)
+	}
+}
+
+func TestDedupRawInput(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	// drop ethernet header
+	frame := udpFrame(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 40000, 53)[14:]
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(i) * time.Millisecond),
+			CaptureLength: len(frame),
+			Length:        len(frame),
+		}, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, _, _ := testDedup(t, buf.Bytes())
+	if res.Duplicates != 1 {
+		t.Fatalf("got %d duplicates, expected 1", res.Duplicates)
+	}
+	if got := res.Sources["unknown"]; got == nil || got.Packets != 2 || len(res.Sources) != 1 {
+		t.Fatalf("raw input not attributed to unknown source: %+v", res.Sources)
+	}
+}
+
+func TestDedupSource(t *testing.T) {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeQinQ,
+		},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	pkt := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+	if source := DedupSource(pkt); source != "00:01:02:03:04:05 vlan=100 vlan=200" {
+		t.Fatalf("got source %q", source)
+	}
+	pkt = gopacket.NewPacket([]byte{0x45}, layers.LinkTypeRaw, gopacket.Default)
+	if source := DedupSource(pkt); source != "unknown" {
+		t.Fatalf("got source %q for raw packet, expected unknown", source)
+	}
+}
@@ -97,9 +97,21 @@ func Open(path string) (io.ReadCloser, error) {
 	if m == Gzip {
 		gzipHandle, err := gzip.NewReader(handle)
 		if err != nil {
+			handle.Close()
 			return nil, err
 		}
-		return gzipHandle, nil
+		return &gzipFile{Reader: gzipHandle, file: handle}, nil
 	}
 	return handle, nil
 }
+
+// gzipFile closes both gzip stream and underlying file handle
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
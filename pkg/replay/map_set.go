@@ -7,6 +7,10 @@ import (
 	"time"
 
 	"github.com/StamusNetworks/gophercap/pkg/models"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/sirupsen/logrus"
 )
 
 type PcapSet struct {
@@ -103,3 +107,47 @@ func (s *PcapSet) FilterFilesByTime(ts time.Time, beginning bool) error {
 	s.Files = files
 	return s.UpdateDelay()
 }
+
+/*
+Subset applies optional file name pattern and time filters on the set.
+*/
+func (s *PcapSet) Subset(pattern *regexp.Regexp, from, to time.Time) error {
+	if pattern != nil {
+		logrus.Info("Filtering pcap files")
+		if err := s.FilterFilesByRegex(pattern); err != nil {
+			return err
+		}
+	}
+	if !from.IsZero() {
+		logrus.Infof("Filtering pcap files to adjust beginning %s", from)
+		if err := s.FilterFilesByTime(from, true); err != nil {
+			return err
+		}
+	}
+	if !to.IsZero() {
+		logrus.Infof("Filtering pcap files to adjust end %s", to)
+		if err := s.FilterFilesByTime(to, false); err != nil {
+			return err
+		}
+	}
+	return s.UpdateDelay()
+}
+
+/*
+LinkType reads link type from first pcap file in set. Files in set are assumed to share it.
+*/
+func (s PcapSet) LinkType() (layers.LinkType, error) {
+	if len(s.Files) == 0 {
+		return layers.LinkTypeNull, errors.New("Missing pcap files")
+	}
+	r, err := Open(s.Files[0].Path)
+	if err != nil {
+		return layers.LinkTypeNull, err
+	}
+	defer r.Close()
+	h, err := pcapgo.NewReader(r)
+	if err != nil {
+		return layers.LinkTypeNull, err
+	}
+	return h.LinkType(), nil
+}
@@ -0,0 +1,326 @@
+package replay
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+MergeConfig holds params for merging a pcap set into a single time ordered output
+*/
+type MergeConfig struct {
+	Set              PcapSet
+	FilterRegex      *regexp.Regexp
+	TimeFrom, TimeTo time.Time
+
+	Output rotate.Config
+
+	Ctx context.Context
+}
+
+/*
+Validate implements a standard interface for checking config struct validity and setting
+sane default values.
+*/
+func (c MergeConfig) Validate() error {
+	if c.Ctx == nil {
+		return errors.New("missing merge stopper context")
+	}
+	if err := c.Set.Validate(); err != nil {
+		return err
+	}
+	if !c.TimeFrom.IsZero() && !c.TimeTo.IsZero() && c.TimeTo.Before(c.TimeFrom) {
+		return errors.New("end time is before start time")
+	}
+	return nil
+}
+
+/*
+Merge reads all files in set in global timestamp order and writes packets into output. Packets
+outside optional time bounds are dropped. Returns metadata of written files.
+*/
+func Merge(c MergeConfig) ([]rotate.File, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	set := c.Set
+	if err := set.Subset(c.FilterRegex, c.TimeFrom, c.TimeTo); err != nil {
+		return nil, err
+	}
+	merger, err := NewMerger(set.Files)
+	if err != nil {
+		return nil, err
+	}
+	defer merger.Close()
+	return mergeInto(c.Ctx, merger, c.Output, c.TimeFrom, c.TimeTo)
+}
+
+/*
+MergeFiles merges freshly written pcap files that have not been mapped into time ordered
+output. Files without packets are ignored. Returns metadata of written files.
+*/
+func MergeFiles(ctx context.Context, paths []string, out rotate.Config) ([]rotate.File, error) {
+	files, err := PeekPcaps(paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return []rotate.File{}, nil
+	}
+	merger, err := NewMerger(files)
+	if err != nil {
+		return nil, err
+	}
+	defer merger.Close()
+	return mergeInto(ctx, merger, out, time.Time{}, time.Time{})
+}
+
+// mergeInto drains merger into rotating output, packets outside optional time bounds are dropped
+func mergeInto(ctx context.Context, merger *Merger, out rotate.Config, from, to time.Time) ([]rotate.File, error) {
+	out.LinkType = merger.LinkType()
+	out.Snaplen = merger.Snaplen()
+	writer, err := rotate.NewWriter(out)
+	if err != nil {
+		return nil, err
+	}
+
+	report := time.NewTicker(5 * time.Second)
+	defer report.Stop()
+	var count, skipped int
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-report.C:
+			logrus.WithFields(logrus.Fields{
+				"written": count,
+				"skipped": skipped,
+			}).Info("merging packets")
+		default:
+		}
+		data, ci, err := merger.ReadPacketData()
+		if err == io.EOF {
+			break loop
+		} else if err != nil {
+			writer.Close()
+			return writer.Files(), err
+		}
+		if !within(ci.Timestamp, from, to) {
+			skipped++
+			continue loop
+		}
+		if err := writer.WritePacket(ci, data); err != nil {
+			writer.Close()
+			return writer.Files(), err
+		}
+		count++
+	}
+	if err := writer.Close(); err != nil {
+		return writer.Files(), err
+	}
+	return writer.Files(), ctx.Err()
+}
+
+/*
+Merger reads packets from multiple pcap files in global timestamp order. Files are only
+opened once merged stream reaches their beginning, so large sets do not exhaust file handles.
+Merger implements gopacket.PacketDataSource.
+*/
+type Merger struct {
+	pending []*Pcap
+	open    mergeHeap
+
+	linkType layers.LinkType
+	snaplen  uint32
+	source   string
+}
+
+type mergeItem struct {
+	path   string
+	handle io.ReadCloser
+	reader *pcapgo.Reader
+
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+// next loads next packet from file into item, returns io.EOF when file is exhausted
+func (m *mergeItem) next() error {
+	data, ci, err := m.reader.ReadPacketData()
+	if err != nil {
+		return err
+	}
+	m.data = data
+	m.ci = ci
+	return nil
+}
+
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i].ci.Timestamp.Before(h[j].ci.Timestamp) }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+/*
+NewMerger creates a new time ordered reader for pcap files. File beginning timestamps are used
+for deciding when each file needs to be opened.
+*/
+func NewMerger(files []*Pcap) (*Merger, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to merge")
+	}
+	pending := make([]*Pcap, len(files))
+	copy(pending, files)
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Beginning.Before(pending[j].Beginning)
+	})
+	m := &Merger{pending: pending, open: make(mergeHeap, 0)}
+	if err := m.openNext(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// LinkType returns link type shared by all merged files
+func (m Merger) LinkType() layers.LinkType { return m.linkType }
+
+// Snaplen returns biggest snaplen of opened files
+func (m Merger) Snaplen() uint32 { return m.snaplen }
+
+// Source returns path of file that last read packet came from
+func (m Merger) Source() string { return m.source }
+
+// ReadPacketData implements gopacket.PacketDataSource
+func (m *Merger) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for len(m.pending) > 0 &&
+		(m.open.Len() == 0 || !m.pending[0].Beginning.After(m.open[0].ci.Timestamp)) {
+		if err := m.openNext(); err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+	}
+	if m.open.Len() == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	item := m.open[0]
+	data, ci := item.data, item.ci
+	m.source = item.path
+	if err := item.next(); err == io.EOF {
+		heap.Pop(&m.open)
+		item.handle.Close()
+	} else if err != nil {
+		return nil, ci, fmt.Errorf("%s: %s", item.path, err)
+	} else {
+		heap.Fix(&m.open, 0)
+	}
+	return data, ci, nil
+}
+
+// Close closes all open file handles
+func (m *Merger) Close() error {
+	for _, item := range m.open {
+		item.handle.Close()
+	}
+	m.open = m.open[:0]
+	m.pending = nil
+	return nil
+}
+
+func (m *Merger) openNext() error {
+	p := m.pending[0]
+	m.pending = m.pending[1:]
+
+	handle, err := Open(p.Path)
+	if err != nil {
+		return err
+	}
+	reader, err := pcapgo.NewReader(handle)
+	if err != nil {
+		handle.Close()
+		return fmt.Errorf("%s: %s", p.Path, err)
+	}
+	if m.linkType == layers.LinkTypeNull {
+		m.linkType = reader.LinkType()
+	} else if m.linkType != reader.LinkType() {
+		handle.Close()
+		return fmt.Errorf("%s link type %s does not match %s", p.Path, reader.LinkType(), m.linkType)
+	}
+	if reader.Snaplen() > m.snaplen {
+		m.snaplen = reader.Snaplen()
+	}
+	item := &mergeItem{path: p.Path, handle: handle, reader: reader}
+	if err := item.next(); err == io.EOF {
+		handle.Close()
+		return nil
+	} else if err != nil {
+		handle.Close()
+		return fmt.Errorf("%s: %s", p.Path, err)
+	}
+	heap.Push(&m.open, item)
+	return nil
+}
+
+/*
+PeekPcaps builds minimal pcap metadata for files that have not been mapped, only the first packet
+is read. Useful for merging freshly written files.
+*/
+func PeekPcaps(paths []string) ([]*Pcap, error) {
+	files := make([]*Pcap, 0, len(paths))
+	for _, path := range paths {
+		handle, err := Open(path)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := pcapgo.NewReader(handle)
+		if err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		_, ci, err := reader.ReadPacketData()
+		handle.Close()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		p := &Pcap{Path: path, Snaplen: reader.Snaplen()}
+		p.Beginning = ci.Timestamp
+		p.End = ci.Timestamp
+		files = append(files, p)
+	}
+	return files, nil
+}
+
+// within reports if timestamp is inside optional time bounds
+func within(ts, from, to time.Time) bool {
+	if !from.IsZero() && ts.Before(from) {
+		return false
+	}
+	if !to.IsZero() && ts.After(to) {
+		return false
+	}
+	return true
+}
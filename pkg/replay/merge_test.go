@@ -0,0 +1,131 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writeTestPcaps stores pcap data under dir and returns file paths in same order
+func writeTestPcaps(t *testing.T, dir string, data ...[]byte) []string {
+	paths := make([]string, len(data))
+	for i, d := range data {
+		paths[i] = filepath.Join(dir, string(rune('a'+i))+".pcap")
+		if err := os.WriteFile(paths[i], d, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func TestMerger(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	paths := writeTestPcaps(t, t.TempDir(),
+		testPcap(t, 5, ts, 3*time.Second),
+		testPcap(t, 5, ts.Add(time.Second), 3*time.Second),
+		// begins while both other files are still open
+		testPcap(t, 4, ts.Add(5*time.Second), time.Second),
+		// empty file is skipped
+		testPcap(t, 0, ts, time.Second),
+	)
+	files, err := PeekPcaps(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("peeked %d non empty files, expected 3", len(files))
+	}
+	// pass files in reverse order of beginning
+	files[0], files[2] = files[2], files[0]
+	merger, err := NewMerger(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merger.Close()
+
+	var last time.Time
+	perSource := make(map[string]int)
+	for {
+		data, ci, err := merger.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if ci.Timestamp.Before(last) {
+			t.Fatalf("packet at %s after %s", ci.Timestamp, last)
+		}
+		last = ci.Timestamp
+		// packets within each file must keep their order
+		if idx := int(data[0])<<8 | int(data[1]); idx != perSource[merger.Source()] {
+			t.Fatalf("%s: got packet %d, expected %d", merger.Source(), idx, perSource[merger.Source()])
+		}
+		perSource[merger.Source()]++
+	}
+	expected := map[string]int{paths[0]: 5, paths[1]: 5, paths[2]: 4}
+	for path, count := range expected {
+		if perSource[path] != count {
+			t.Fatalf("%s: merged %d packets, expected %d", path, perSource[path], count)
+		}
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	paths := writeTestPcaps(t, dir,
+		testPcap(t, 5, ts, 2*time.Second),
+		testPcap(t, 5, ts.Add(time.Second), 2*time.Second),
+	)
+	out := t.TempDir()
+	written, err := MergeFiles(context.Background(), paths, rotate.Config{
+		Dir:        out,
+		Template:   "merged.%t.pcap",
+		MaxPackets: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := []int{4, 4, 2}
+	if len(written) != len(counts) {
+		t.Fatalf("got %d output files, expected %d", len(written), len(counts))
+	}
+	var idx int
+	for i, f := range written {
+		if f.Packets != counts[i] {
+			t.Fatalf("%s: %d packets, expected %d", f.Path, f.Packets, counts[i])
+		}
+		handle, err := os.Open(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := pcapgo.NewReader(handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, ci, err := reader.ReadPacketData()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			// inputs interleave, so merged output is one packet per second
+			if expected := ts.Add(time.Duration(idx) * time.Second); !ci.Timestamp.Equal(expected) {
+				t.Fatalf("packet %d at %s, expected %s", idx, ci.Timestamp, expected)
+			}
+			idx++
+		}
+		handle.Close()
+	}
+	if idx != 10 {
+		t.Fatalf("read %d merged packets, expected 10", idx)
+	}
+}
@@ -17,15 +17,21 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package replay
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"sort"
 	"time"
 
+	"github.com/StamusNetworks/gophercap/pkg/filter"
 	"github.com/StamusNetworks/gophercap/pkg/models"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
 	"github.com/sirupsen/logrus"
@@ -40,10 +46,12 @@ Config is used for passing Handle configurations when creating a new replay obje
 type Config struct {
 	Set            PcapSet
 	WriteInterface string
-	FilterRegex    *regexp.Regexp
-	OutBpf         string
-	DisableWait    bool
-	Reorder        bool
+	// WriteFile replays packets into a pcap file instead of network interface
+	WriteFile   string
+	FilterRegex *regexp.Regexp
+	OutBpf      string
+	DisableWait bool
+	Reorder     bool
 
 	ScaleDuration time.Duration
 	ScaleEnabled  bool
@@ -52,6 +60,22 @@ type Config struct {
 	SkipOutOfOrder bool
 	SkipMTU        int
 
+	// Decapsulate removes tunnel headers before sending, so inner packets are replayed
+	Decapsulate bool
+
+	// LoopCount is number of iterations over the set, values less than 1 loop forever
+	LoopCount    int
+	LoopInfinite bool
+	// LoopPause is time to wait between end of one iteration and start of the next
+	LoopPause time.Duration
+	// LoopOverlap starts the next iteration before current one has finished
+	LoopOverlap time.Duration
+
+	// RewriteTimestamps shifts packet timestamps so that set appears to begin at RewriteEpoch
+	RewriteTimestamps bool
+	// RewriteEpoch is new beginning of the set, current time is used if left empty
+	RewriteEpoch time.Time
+
 	TimeFrom, TimeTo time.Time
 	Ctx              context.Context
 }
@@ -67,9 +91,22 @@ func (c Config) Validate() error {
 	if err := c.Set.Validate(); err != nil {
 		return err
 	}
+	if c.WriteInterface == "" && c.WriteFile == "" {
+		return errors.New("missing output interface or file")
+	}
+	if c.WriteFile != "" && c.DisableWait {
+		// concurrent readers would interleave packets out of timestamp order
+		return errors.New("disable wait is not supported with pcap file output, use merge subcommand instead")
+	}
 	if c.ScaleEnabled && c.ScaleDuration == 0 {
 		return errors.New("Time scaling enabled but duration not defined")
 	}
+	if c.LoopPause < 0 || c.LoopOverlap < 0 {
+		return errors.New("loop pause and overlap must not be negative")
+	}
+	if c.LoopPause > 0 && c.LoopOverlap > 0 {
+		return errors.New("loop pause and overlap are mutually exclusive")
+	}
 	return nil
 }
 
@@ -81,11 +118,24 @@ type Handle struct {
 	speedMod    float64
 	scale       bool
 	iface       string
+	outFile     string
 	disableWait bool
 	skipOOO     bool
 	skipMTU     int
 	outBpf      string
 	reorder     bool
+	decap       bool
+	linkType    layers.LinkType
+
+	loopCount    int
+	loopInfinite bool
+	loopPause    time.Duration
+	loopOverlap  time.Duration
+
+	rewrite bool
+	epoch   time.Time
+
+	ctx context.Context
 }
 
 /*
@@ -96,33 +146,24 @@ func NewHandle(c Config) (*Handle, error) {
 		return nil, err
 	}
 	h := &Handle{
-		FileSet:     c.Set,
-		iface:       c.WriteInterface,
-		outBpf:      c.OutBpf,
-		disableWait: c.DisableWait,
-		skipOOO:     c.SkipOutOfOrder,
-		skipMTU:     c.SkipMTU,
-		reorder:     c.Reorder,
-	}
-	if c.FilterRegex != nil {
-		logrus.Info("Filtering pcap files")
-		if err := h.FileSet.FilterFilesByRegex(c.FilterRegex); err != nil {
-			return h, err
-		}
-	}
-	if !c.TimeFrom.IsZero() {
-		logrus.Infof("Filtering pcap files to adjust replay beginning %s", c.TimeFrom)
-		if err := h.FileSet.FilterFilesByTime(c.TimeFrom, true); err != nil {
-			return h, err
-		}
-	}
-	if !c.TimeTo.IsZero() {
-		logrus.Infof("Filtering pcap files to adjust replay end %s", c.TimeTo)
-		if err := h.FileSet.FilterFilesByTime(c.TimeTo, false); err != nil {
-			return h, err
-		}
+		FileSet:      c.Set,
+		iface:        c.WriteInterface,
+		outFile:      c.WriteFile,
+		outBpf:       c.OutBpf,
+		disableWait:  c.DisableWait,
+		skipOOO:      c.SkipOutOfOrder,
+		skipMTU:      c.SkipMTU,
+		reorder:      c.Reorder,
+		decap:        c.Decapsulate,
+		loopCount:    c.LoopCount,
+		loopInfinite: c.LoopInfinite || c.LoopCount < 1,
+		loopPause:    c.LoopPause,
+		loopOverlap:  c.LoopOverlap,
+		rewrite:      c.RewriteTimestamps,
+		epoch:        c.RewriteEpoch,
+		ctx:          c.Ctx,
 	}
-	if err := h.FileSet.UpdateDelay(); err != nil {
+	if err := h.FileSet.Subset(c.FilterRegex, c.TimeFrom, c.TimeTo); err != nil {
 		return nil, err
 	}
 	if c.ScaleEnabled {
@@ -138,15 +179,197 @@ func NewHandle(c Config) (*Handle, error) {
 	} else {
 		h.speedMod = 1
 	}
+	if h.loopOverlap > 0 && h.loopOverlap >= h.iterationDuration() {
+		return nil, errors.New("loop overlap must be shorter than replay duration")
+	}
 
 	return h, nil
 }
 
+// iterationDuration is expected wall clock duration of a single pass over the set
+func (h Handle) iterationDuration() time.Duration {
+	return h.FileSet.Duration() / time.Duration(h.speedMod)
+}
+
+// iteration holds state shared by all pcap readers in a single pass over the set
+type iteration struct {
+	ID    int
+	Start time.Time
+	// Offset is iteration start relative to beginning of replay
+	Offset time.Duration
+}
+
+// timestamp maps original packet timestamp into replay timeline
+func (h Handle) timestamp(it iteration, ts time.Time) time.Time {
+	if !h.rewrite {
+		return ts
+	}
+	return h.epoch.
+		Add(it.Offset).
+		Add(ts.Sub(h.FileSet.Beginning) / time.Duration(h.speedMod))
+}
+
 // Play starts the replay sequence once Handle object has been constructed
 func (h *Handle) Play() error {
-	packets := make(chan []byte)
+	if h.decap {
+		linkType, err := h.FileSet.LinkType()
+		if err != nil {
+			return err
+		}
+		// inner packets are ethernet frames, so only ethernet input keeps output consistent
+		if linkType != layers.LinkTypeEthernet {
+			return fmt.Errorf("decapsulation needs ethernet input, set has link type %s", linkType)
+		}
+		h.linkType = linkType
+	}
+
+	writer, err := h.openSink()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	start := time.Now()
+	if h.rewrite && h.epoch.IsZero() {
+		h.epoch = start
+	}
+	if h.rewrite {
+		logrus.WithField("epoch", h.epoch).Info("rewriting packet timestamps")
+	}
+
+	packets := make(chan packet)
+
+	pool, ctx := errgroup.WithContext(h.ctx)
+	pool.Go(func() error {
+		return h.writePackets(ctx, writer, packets)
+	})
+	pool.Go(func() error {
+		defer close(packets)
+		return h.loop(ctx, start, packets)
+	})
+	return pool.Wait()
+}
+
+func (h Handle) openSink() (sink, error) {
+	if h.outFile != "" {
+		linkType, err := h.FileSet.LinkType()
+		if err != nil {
+			return nil, err
+		}
+		return newFileSink(h.outFile, linkType)
+	}
+	writer, err := pcap.OpenLive(h.iface, 65536, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	if h.outBpf != "" {
+		if err := writer.SetBPFFilter(h.outBpf); err != nil {
+			writer.Close()
+			return nil, err
+		}
+	}
+	return &ifaceSink{Handle: writer}, nil
+}
+
+// sink is the destination of replayed packets
+type sink interface {
+	WritePacket(packet) error
+	Close() error
+}
+
+type ifaceSink struct {
+	*pcap.Handle
+}
+
+func (s *ifaceSink) WritePacket(pkt packet) error {
+	return s.WritePacketData(pkt.Payload)
+}
+
+func (s *ifaceSink) Close() error {
+	s.Handle.Close()
+	return nil
+}
+
+type fileSink struct {
+	file   *os.File
+	buf    *bufio.Writer
+	writer *pcapgo.Writer
+}
+
+func newFileSink(path string, linkType layers.LinkType) (*fileSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriterSize(f, 1024*64)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, linkType); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileSink{file: f, buf: buf, writer: w}, nil
+}
+
+func (s *fileSink) WritePacket(pkt packet) error {
+	return s.writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     pkt.Timestamp,
+		CaptureLength: len(pkt.Payload),
+		Length:        len(pkt.Payload),
+	}, pkt.Payload)
+}
 
-	pool, ctx := errgroup.WithContext(context.Background())
+func (s *fileSink) Close() error {
+	if err := s.buf.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// loop schedules iterations over the set while keeping a single writer open
+func (h *Handle) loop(ctx context.Context, start time.Time, packets chan<- packet) error {
+	pool, ctx := errgroup.WithContext(ctx)
+	next := start
+
+loop:
+	for id := 1; h.loopInfinite || id <= h.loopCount; id++ {
+		it := iteration{ID: id, Start: next, Offset: next.Sub(start)}
+		logrus.WithFields(logrus.Fields{
+			"iteration": it.ID,
+			"estimate":  h.iterationDuration(),
+		}).Info("starting iteration")
+
+		current := h.playIteration(ctx, it, packets)
+		pool.Go(current.Wait)
+
+		if h.loopOverlap > 0 {
+			next = it.Start.Add(h.iterationDuration() - h.loopOverlap)
+		} else {
+			if err := current.Wait(); err != nil {
+				return err
+			}
+			logrus.Infof("Iteration %d done in %s.", it.ID, time.Since(it.Start))
+			next = time.Now().Add(h.loopPause)
+		}
+		if !h.loopInfinite && id == h.loopCount {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-time.After(time.Until(next)):
+		}
+	}
+	return pool.Wait()
+}
+
+// playIteration starts a reader for each pcap file in set
+func (h *Handle) playIteration(
+	ctx context.Context,
+	it iteration,
+	packets chan<- packet,
+) *errgroup.Group {
+	pool, ctx := errgroup.WithContext(ctx)
 	for _, p := range h.FileSet.Files {
 		type params struct {
 			Path  string
@@ -197,11 +420,16 @@ func (h *Handle) Play() error {
 				"pcap":           vals.Path,
 				"estimate":       scaledLocalDuration,
 				"batch_reorder":  h.reorder,
+				"iteration":      it.ID,
 			})
 			lctx.Info("starting replay worker")
 
 			if !h.disableWait {
-				time.Sleep(vals.Delay)
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(time.Until(it.Start.Add(vals.Delay))):
+				}
 				if vals.Delay > 0 {
 					lctx.Debug("delay done, playing pcap")
 				}
@@ -216,6 +444,7 @@ func (h *Handle) Play() error {
 					"out_of_order":   outOfOrder,
 					"sent_pkts":      count,
 					"delay":          vals.Delay,
+					"iteration":      it.ID,
 				}).Debug("file replay done")
 			}()
 
@@ -227,7 +456,7 @@ func (h *Handle) Play() error {
 				fn = sendPerPacket
 			}
 
-			res, err := fn(vals.Beginning, reader, packets, *h)
+			res, err := fn(ctx, it, vals.Beginning, reader, packets, *h)
 			if err != nil {
 				return err
 			}
@@ -237,57 +466,61 @@ func (h *Handle) Play() error {
 			return nil
 		})
 	}
+	return pool
+}
 
-	writer, err := pcap.OpenLive(h.iface, 65536, true, pcap.BlockForever)
-	if err != nil {
-		return err
-	}
-	defer writer.Close()
-	if h.outBpf != "" {
-		if err := writer.SetBPFFilter(h.outBpf); err != nil {
-			return err
-		}
-	}
-
-	go func() {
-		defer close(packets)
-
-		var counter, oversize uint64
-		ticker := time.NewTicker(5 * time.Second)
-		start := time.Now()
+// writePackets consumes packets from all readers until channel is closed
+func (h *Handle) writePackets(ctx context.Context, writer sink, packets <-chan packet) error {
+	var counter, oversize, decapErrors uint64
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	start := time.Now()
 
-	loop:
-		for {
-			select {
-			case <-ctx.Done():
-				break loop
-			case <-ticker.C:
-				logrus.WithFields(logrus.Fields{
-					"written":  counter,
-					"pps":      int(float64(counter) / time.Since(start).Seconds()),
-					"oversize": oversize,
-				}).Info("packets written")
-			case packet, ok := <-packets:
-				if !ok {
-					break loop
-				}
-				if len(packet) > h.skipMTU {
-					oversize++
-					continue loop
-				}
-				if err := writer.WritePacketData(packet); err != nil {
-					logrus.Error(err)
-					break loop
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			logrus.WithFields(logrus.Fields{
+				"written":   counter,
+				"pps":       int(float64(counter) / time.Since(start).Seconds()),
+				"oversize":  oversize,
+				"decap_err": decapErrors,
+			}).Info("packets written")
+		case packet, ok := <-packets:
+			if !ok {
+				return nil
+			}
+			if h.decap {
+				data, err := h.decapsulate(packet.Payload)
+				if err != nil {
+					decapErrors++
 				}
-				counter++
+				packet.Payload = data
+			}
+			if len(packet.Payload) > h.skipMTU {
+				oversize++
+				continue
 			}
+			if err := writer.WritePacket(packet); err != nil {
+				return err
+			}
+			counter++
 		}
-	}()
+	}
+}
 
-	return pool.Wait()
+// decapsulate returns inner packet of tunneled traffic, last good level is kept on error
+func (h Handle) decapsulate(data []byte) ([]byte, error) {
+	pkt := gopacket.NewPacket(data, h.linkType, gopacket.Default)
+	inner, info, err := filter.Decapsulate(pkt, 0)
+	if info.Depth() == 0 {
+		return data, err
+	}
+	return inner.Data(), err
 }
 
-type pktSendFunc func(time.Time, *pcapgo.Reader, chan<- []byte, Handle) (*result, error)
+type pktSendFunc func(context.Context, iteration, time.Time, *pcapgo.Reader, chan<- packet, Handle) (*result, error)
 
 type result struct {
 	count      int
@@ -295,9 +528,11 @@ type result struct {
 }
 
 func sendPerPacket(
+	ctx context.Context,
+	it iteration,
 	last time.Time,
 	reader *pcapgo.Reader,
-	packets chan<- []byte,
+	packets chan<- packet,
 	h Handle,
 ) (*result, error) {
 	res := &result{}
@@ -321,7 +556,11 @@ loop:
 		if delay > DelayGrace && !ci.Timestamp.Before(last) {
 			time.Sleep(delay)
 		}
-		packets <- data
+		select {
+		case packets <- packet{Payload: data, Timestamp: h.timestamp(it, ci.Timestamp)}:
+		case <-ctx.Done():
+			break loop
+		}
 		last = ci.Timestamp
 		res.count++
 	}
@@ -329,9 +568,11 @@ loop:
 }
 
 func sendBatchReorder(
+	ctx context.Context,
+	it iteration,
 	last time.Time,
 	reader *pcapgo.Reader,
-	packets chan<- []byte,
+	packets chan<- packet,
 	h Handle,
 ) (*result, error) {
 	res := &result{}
@@ -353,11 +594,14 @@ loop:
 		})
 
 		if res.count%100 == 0 {
-			last = sendPackets(b, packets, int64(h.speedMod), h.scale, last)
+			last = sendPackets(ctx, b, packets, h, it, last)
 			b = make(pBuf, 0, 100)
 		}
 		res.count++
 	}
+	if len(b) > 0 {
+		sendPackets(ctx, b, packets, h, it, last)
+	}
 	return res, nil
 }
 
@@ -369,10 +613,11 @@ type packet struct {
 }
 
 func sendPackets(
+	ctx context.Context,
 	b pBuf,
-	tx chan<- []byte,
-	mod int64,
-	scale bool,
+	tx chan<- packet,
+	h Handle,
+	it iteration,
 	prevLast time.Time,
 ) (last time.Time) {
 	sort.Slice(b, func(i, j int) bool {
@@ -381,11 +626,15 @@ func sendPackets(
 
 	last = prevLast
 	for _, pkt := range b {
-		delay := pkt.Timestamp.Sub(last) / time.Duration(mod)
+		delay := pkt.Timestamp.Sub(last) / time.Duration(h.speedMod)
 		if delay > DelayGrace {
 			time.Sleep(delay)
 		}
-		tx <- pkt.Payload
+		select {
+		case tx <- packet{Payload: pkt.Payload, Timestamp: h.timestamp(it, pkt.Timestamp)}:
+		case <-ctx.Done():
+			return last
+		}
 		last = pkt.Timestamp
 	}
 	return last
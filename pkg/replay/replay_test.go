@@ -0,0 +1,173 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/models"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// testPcap builds pcap data with count packets, step apart starting from ts
+func testPcap(t *testing.T, count int, ts time.Time, step time.Duration) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		data := []byte{byte(i >> 8), byte(i)}
+		if err := w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(i) * step),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestSendBatchReorder(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, count := range []int{1, 99, 100, 101, 250} {
+		reader, err := pcapgo.NewReader(bytes.NewReader(testPcap(t, count, ts, time.Microsecond)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets := make(chan packet, count)
+		res, err := sendBatchReorder(context.Background(), iteration{}, ts, reader, packets, Handle{speedMod: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		close(packets)
+		if res.count != count {
+			t.Fatalf("%d packets: read %d", count, res.count)
+		}
+		var sent int
+		for pkt := range packets {
+			if idx := int(pkt.Payload[0])<<8 | int(pkt.Payload[1]); idx != sent {
+				t.Fatalf("%d packets: got packet %d at position %d", count, idx, sent)
+			}
+			sent++
+		}
+		if sent != count {
+			t.Fatalf("%d packets: sent %d, last batch not flushed", count, sent)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	period := models.Period{
+		Beginning: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		End:       time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+	}
+	c := Config{
+		Set:       PcapSet{Period: period, Files: []*Pcap{{Path: "a.pcap", Period: period}}},
+		WriteFile: "out.pcap",
+		Ctx:       context.Background(),
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.DisableWait = true
+	if err := c.Validate(); err == nil {
+		t.Fatal("disable wait with file output should be rejected")
+	}
+	c.WriteFile = ""
+	c.WriteInterface = "eth0"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testLoop replays a set of 3 packets 100ms apart and returns output timestamps
+func testLoop(t *testing.T, c Config) ([]time.Time, time.Duration) {
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	paths := writeTestPcaps(t, dir, testPcap(t, 3, ts, 100*time.Millisecond))
+	period := models.Period{Beginning: ts, End: ts.Add(200 * time.Millisecond)}
+	c.Set = PcapSet{Period: period, Files: []*Pcap{{Path: paths[0], Period: period}}}
+	c.WriteFile = filepath.Join(dir, "out.pcap")
+	c.SkipMTU = 1514
+	c.RewriteTimestamps = true
+	c.RewriteEpoch = ts
+	c.Ctx = context.Background()
+
+	h, err := NewHandle(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := h.Play(); err != nil {
+		t.Fatal(err)
+	}
+	took := time.Since(start)
+
+	f, err := os.Open(c.WriteFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []time.Time
+	for {
+		_, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, ts.Add(ci.Timestamp.Sub(ts).Round(10*time.Millisecond)))
+	}
+	return out, took
+}
+
+func TestHandleLoop(t *testing.T) {
+	out, took := testLoop(t, Config{LoopCount: 2})
+	if len(out) != 6 {
+		t.Fatalf("got %d packets from 2 iterations, expected 6", len(out))
+	}
+	if took < 400*time.Millisecond {
+		t.Fatalf("2 iterations took %s, expected at least 400ms", took)
+	}
+
+	// no pause after last iteration
+	out, took = testLoop(t, Config{LoopCount: 2, LoopPause: 500 * time.Millisecond})
+	if len(out) != 6 {
+		t.Fatalf("got %d packets with pause, expected 6", len(out))
+	}
+	if took < 900*time.Millisecond || took > 1250*time.Millisecond {
+		t.Fatalf("2 iterations with 500ms pause took %s, expected about 900ms", took)
+	}
+
+	// second iteration starts 100ms before first one ends
+	out, took = testLoop(t, Config{LoopCount: 2, LoopOverlap: 100 * time.Millisecond})
+	if took > 450*time.Millisecond {
+		t.Fatalf("2 overlapping iterations took %s, expected about 300ms", took)
+	}
+	offsets := map[time.Duration]int{}
+	for _, ts := range out {
+		offsets[ts.Sub(out[0])]++
+	}
+	expected := map[time.Duration]int{0: 1, 100 * time.Millisecond: 2, 200 * time.Millisecond: 2, 300 * time.Millisecond: 1}
+	if len(out) != 6 || len(offsets) != len(expected) {
+		t.Fatalf("unexpected overlapping packet offsets %v", offsets)
+	}
+	for offset, count := range expected {
+		if offsets[offset] != count {
+			t.Fatalf("unexpected overlapping packet offsets %v", offsets)
+		}
+	}
+}
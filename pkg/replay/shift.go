@@ -0,0 +1,249 @@
+package replay
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+/*
+ShiftConfig holds parameters for rewriting packet timestamps in a pcap set
+*/
+type ShiftConfig struct {
+	Set PcapSet
+	// Offset is added to every packet timestamp
+	Offset time.Duration
+	// Epoch is new beginning of the set, overrides Offset if defined
+	Epoch time.Time
+
+	OutDir   string
+	Compress bool
+	Workers  int
+
+	Ctx context.Context
+}
+
+/*
+Validate implements a standard interface for checking config struct validity and setting
+sane default values.
+*/
+func (c ShiftConfig) Validate() error {
+	if err := c.Set.Validate(); err != nil {
+		return err
+	}
+	if c.OutDir == "" {
+		return errors.New("missing output dir")
+	}
+	if c.Workers < 1 {
+		return errors.New("Worker count should be > 0")
+	}
+	if c.Offset == 0 && c.Epoch.IsZero() {
+		return errors.New("missing time offset or new epoch")
+	}
+	inputs := make(map[string]string, len(c.Set.Files))
+	for _, f := range c.Set.Files {
+		path, err := filepath.Abs(f.Path)
+		if err != nil {
+			return err
+		}
+		inputs[path] = f.Path
+	}
+	seen := make(map[string]string, len(c.Set.Files))
+	for _, f := range c.Set.Files {
+		name := shiftedName(f.Path, c.Compress)
+		if prev, ok := seen[name]; ok {
+			return fmt.Errorf("%s and %s would be written to same output file %s", prev, f.Path, name)
+		}
+		seen[name] = f.Path
+		out, err := filepath.Abs(filepath.Join(c.OutDir, name))
+		if err != nil {
+			return err
+		}
+		if input, ok := inputs[out]; ok {
+			return fmt.Errorf("%s would overwrite input %s, use another output dir", f.Path, input)
+		}
+	}
+	return nil
+}
+
+/*
+ShiftSet rewrites packet timestamps for all files in set. Same offset is applied to each
+file, so relative timing across files is preserved. Returns a new set describing shifted
+files.
+*/
+func ShiftSet(c ShiftConfig) (*PcapSet, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	offset := c.Offset
+	if !c.Epoch.IsZero() {
+		offset = c.Epoch.Sub(c.Set.Beginning)
+	}
+	logrus.WithFields(logrus.Fields{
+		"offset":    offset,
+		"beginning": c.Set.Beginning.Add(offset),
+		"end":       c.Set.End.Add(offset),
+	}).Info("shifting pcap set")
+
+	ctx := c.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	pool, ctx := errgroup.WithContext(ctx)
+	pool.SetLimit(c.Workers)
+
+	shifted := &PcapSet{Files: make([]*Pcap, len(c.Set.Files))}
+	for i, f := range c.Set.Files {
+		i, f := i, *f
+		pool.Go(func() error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			out := filepath.Join(c.OutDir, shiftedName(f.Path, c.Compress))
+			start := time.Now()
+			count, err := ShiftFile(f.Path, out, offset, c.Compress)
+			if err != nil {
+				return fmt.Errorf("%s: %s", f.Path, err)
+			}
+			logrus.WithFields(logrus.Fields{
+				"input":   f.Path,
+				"output":  out,
+				"packets": count,
+				"took":    time.Since(start),
+			}).Info("file shifted")
+			f.Path = out
+			f.Beginning = f.Beginning.Add(offset)
+			f.End = f.End.Add(offset)
+			shifted.Files[i] = &f
+			return nil
+		})
+	}
+	if err := pool.Wait(); err != nil {
+		return nil, err
+	}
+	return shifted, shifted.UpdateDelay()
+}
+
+/*
+ShiftFile adds offset to timestamp of each packet in input and writes result to output.
+Output keeps nanosecond timestamps of input. Output must not be the input file, as it would
+be truncated before it is read.
+*/
+func ShiftFile(input, output string, offset time.Duration, compress bool) (int, error) {
+	if err := checkNotSameFile(input, output); err != nil {
+		return 0, err
+	}
+	in, err := Open(input)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	header, err := br.Peek(4)
+	if err != nil {
+		return 0, err
+	}
+	nanos := nanosecondPcap(header)
+	reader, err := pcapgo.NewReader(br)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return 0, err
+	}
+	buf := bufio.NewWriterSize(f, 1024*64)
+	var gw *gzip.Writer
+	var w io.Writer = buf
+	if compress {
+		gw = gzip.NewWriter(buf)
+		w = gw
+	}
+	writer := pcapgo.NewWriter(w)
+	if nanos {
+		writer = pcapgo.NewWriterNanos(w)
+	}
+	count, err := shiftPackets(reader, writer, offset)
+
+	// close in order so that gzip footer is flushed before file is closed
+	if gw != nil {
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if ferr := buf.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return count, err
+}
+
+func shiftPackets(reader *pcapgo.Reader, writer *pcapgo.Writer, offset time.Duration) (int, error) {
+	if err := writer.WriteFileHeader(reader.Snaplen(), reader.LinkType()); err != nil {
+		return 0, err
+	}
+	var count int
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		ci.Timestamp = ci.Timestamp.Add(offset)
+		if err := writer.WritePacket(ci, data); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// checkNotSameFile errors if output already exists and is input file, also through links
+func checkNotSameFile(input, output string) error {
+	outStat, err := os.Stat(output)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	inStat, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(inStat, outStat) {
+		return fmt.Errorf("output %s is same file as input %s", output, input)
+	}
+	return nil
+}
+
+/*
+nanosecondPcap checks pcap header magic for nanosecond timestamps. Resolution reported by
+pcapgo reader is reversed in gopacket v1.1.19, so header is checked directly.
+*/
+func nanosecondPcap(header []byte) bool {
+	magic := binary.LittleEndian.Uint32(header)
+	return magic == 0xa1b23c4d || magic == 0x4d3cb2a1
+}
+
+func shiftedName(path string, compress bool) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".gz")
+	if compress {
+		name += ".gz"
+	}
+	return name
+}
@@ -0,0 +1,157 @@
+package replay
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/models"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestShiftFile(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	input := filepath.Join(dir, "in.pcap")
+	if err := os.WriteFile(input, testPcap(t, 10, ts, time.Second), 0640); err != nil {
+		t.Fatal(err)
+	}
+	offset := 48 * time.Hour
+	for _, compress := range []bool{false, true} {
+		output := filepath.Join(dir, shiftedName("out.pcap", compress))
+		count, err := ShiftFile(input, output, offset, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 10 {
+			t.Fatalf("compress %t: shifted %d packets, expected 10", compress, count)
+		}
+		if m, err := magic(output); err != nil || (m == Gzip) != compress {
+			t.Fatalf("compress %t: output magic %v, err %v", compress, m, err)
+		}
+		f, err := Open(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := pcapgo.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			data, ci, err := reader.ReadPacketData()
+			if err != nil {
+				t.Fatalf("compress %t: packet %d: %s", compress, i, err)
+			}
+			if idx := int(data[0])<<8 | int(data[1]); idx != i {
+				t.Fatalf("compress %t: got packet %d at position %d", compress, idx, i)
+			}
+			if expected := ts.Add(time.Duration(i) * time.Second).Add(offset); !ci.Timestamp.Equal(expected) {
+				t.Fatalf("compress %t: packet %d timestamp %s, expected %s", compress, i, ci.Timestamp, expected)
+			}
+		}
+		// truncated gzip stream would end with unexpected EOF instead
+		if _, _, err := reader.ReadPacketData(); err != io.EOF {
+			t.Fatalf("compress %t: expected EOF after %d packets, got %v", compress, count, err)
+		}
+		f.Close()
+	}
+}
+
+func TestShiftFileNanos(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	var buf bytes.Buffer
+	w := pcapgo.NewWriterNanos(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(i) * time.Nanosecond),
+			CaptureLength: 2,
+			Length:        2,
+		}, []byte{0, byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := filepath.Join(dir, "in.pcap")
+	if err := os.WriteFile(input, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out.pcap")
+	if _, err := ShiftFile(input, output, time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, ci, err := reader.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := ts.Add(time.Hour + time.Duration(i)*time.Nanosecond); !ci.Timestamp.Equal(expected) {
+			t.Fatalf("packet %d timestamp %s, expected %s", i, ci.Timestamp, expected)
+		}
+	}
+}
+
+func TestShiftInPlace(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	data := testPcap(t, 10, ts, time.Second)
+	input := filepath.Join(dir, "in.pcap")
+	if err := os.WriteFile(input, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.pcap")
+	if err := os.Symlink(input, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, output := range []string{input, link, filepath.Join(dir, ".", "in.pcap")} {
+		if _, err := ShiftFile(input, output, time.Hour, false); err == nil {
+			t.Fatalf("shifting %s into %s should fail", input, output)
+		}
+	}
+	if got, err := os.ReadFile(input); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("input was modified, err %v", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ShiftConfig{
+		Set: PcapSet{
+			Files:  []*Pcap{{Path: input, Period: models.Period{Beginning: ts, End: ts.Add(9 * time.Second)}}},
+			Period: models.Period{Beginning: ts, End: ts.Add(9 * time.Second)},
+		},
+		// same dir written differently
+		OutDir:  rel,
+		Offset:  time.Hour,
+		Workers: 1,
+	}
+	if err := c.Validate(); err == nil {
+		t.Fatal("output dir same as input dir should fail validation")
+	}
+	c.Compress = true
+	if err := c.Validate(); err != nil {
+		t.Fatalf("compressed output has different name, got %s", err)
+	}
+}
@@ -0,0 +1,163 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+SplitConfig holds params for splitting pcap files into multiple rotated outputs
+*/
+type SplitConfig struct {
+	Files []string
+
+	// Output is used as template for each flow bucket, Stream is replaced with bucket number
+	Output rotate.Config
+	// FlowBuckets distributes packets between outputs by symmetric 5-tuple hash, 0 disables
+	FlowBuckets int
+
+	Ctx context.Context
+}
+
+/*
+Validate implements a standard interface for checking config struct validity and setting
+sane default values.
+*/
+func (c SplitConfig) Validate() error {
+	if c.Ctx == nil {
+		return errors.New("missing split stopper context")
+	}
+	if len(c.Files) == 0 {
+		return errors.New("no input files to split")
+	}
+	if c.FlowBuckets < 0 {
+		return errors.New("flow bucket count must not be negative")
+	}
+	if c.FlowBuckets > 1 && !strings.Contains(c.Output.Template, "%n") &&
+		!strings.Contains(c.Output.Template, "%i") {
+		return errors.New("flow buckets need %n in output file name template")
+	}
+	if !c.Output.Rotates() && c.FlowBuckets < 2 {
+		return errors.New("no rotation limit nor flow buckets defined, nothing to split")
+	}
+	return nil
+}
+
+/*
+Split reads input files in global timestamp order and writes packets into rotated output
+files. Returns metadata for all written files.
+*/
+func Split(c SplitConfig) ([]rotate.File, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	files, err := PeekPcaps(c.Files)
+	if err != nil {
+		return nil, err
+	}
+	merger, err := NewMerger(files)
+	if err != nil {
+		return nil, err
+	}
+	defer merger.Close()
+
+	buckets := c.FlowBuckets
+	if buckets < 1 {
+		buckets = 1
+	}
+	writers := make([]*rotate.Writer, buckets)
+	for i := range writers {
+		out := c.Output
+		out.Stream = i
+		out.LinkType = merger.LinkType()
+		out.Snaplen = merger.Snaplen()
+		w, err := rotate.NewWriter(out)
+		if err != nil {
+			return nil, err
+		}
+		writers[i] = w
+	}
+	written := func() []rotate.File {
+		out := make([]rotate.File, 0)
+		for _, w := range writers {
+			out = append(out, w.Files()...)
+		}
+		return out
+	}
+	closeAll := func() error {
+		var first error
+		for _, w := range writers {
+			if err := w.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+
+	report := time.NewTicker(5 * time.Second)
+	defer report.Stop()
+	var count int
+
+loop:
+	for {
+		select {
+		case <-c.Ctx.Done():
+			break loop
+		case <-report.C:
+			logrus.WithField("written", count).Info("splitting packets")
+		default:
+		}
+		data, ci, err := merger.ReadPacketData()
+		if err == io.EOF {
+			break loop
+		} else if err != nil {
+			closeAll()
+			return written(), err
+		}
+		var bucket int
+		if buckets > 1 {
+			bucket = int(FlowHash(data, merger.LinkType()) % uint64(buckets))
+		}
+		if err := writers[bucket].WritePacket(ci, data); err != nil {
+			closeAll()
+			return written(), fmt.Errorf("bucket %d: %s", bucket, err)
+		}
+		count++
+	}
+	if err := closeAll(); err != nil {
+		return written(), err
+	}
+	return written(), c.Ctx.Err()
+}
+
+/*
+FlowHash computes a symmetric hash of packet network and transport endpoints, so both
+directions of a flow get the same value. Packets without network layer hash to 0.
+*/
+func FlowHash(data []byte, linkType layers.LinkType) uint64 {
+	pkt := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	network := pkt.NetworkLayer()
+	if network == nil {
+		return 0
+	}
+	h := network.NetworkFlow().FastHash()
+	if transport := pkt.TransportLayer(); transport != nil {
+		// FastHash is symmetric for each flow, so combined hash stays symmetric
+		h ^= transport.TransportFlow().FastHash() * 0x9e3779b97f4a7c15
+	}
+	// fnv low bits are poorly distributed for similar endpoints, mix before bucketing
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
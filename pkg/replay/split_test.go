@@ -0,0 +1,198 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/rotate"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func udpFrame(t *testing.T, src, dst net.IP, sport, dport uint16) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: src, DstIP: dst, Protocol: layers.IPProtocolUDP}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip, udp, gopacket.Payload("split"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pcapOf builds pcap data from frames, step apart starting from ts
+func pcapOf(t *testing.T, ts time.Time, step time.Duration, frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range frames {
+		if err := w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(i) * step),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func readTestPcap(t *testing.T, path string) [][]byte {
+	handle, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	reader, err := pcapgo.NewReader(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make([][]byte, 0)
+	for {
+		data, _, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, data)
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	a, b := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	forward := FlowHash(udpFrame(t, a, b, 40000, 53), layers.LinkTypeEthernet)
+	reverse := FlowHash(udpFrame(t, b, a, 53, 40000), layers.LinkTypeEthernet)
+	if forward != reverse {
+		t.Fatalf("flow hash not symmetric: %x and %x", forward, reverse)
+	}
+	if other := FlowHash(udpFrame(t, a, b, 40001, 53), layers.LinkTypeEthernet); other == forward {
+		t.Fatal("different flows got same hash")
+	}
+	if h := FlowHash([]byte{0, 1}, layers.LinkTypeEthernet); h != 0 {
+		t.Fatalf("packet without network layer hashed to %x", h)
+	}
+}
+
+func TestSplitFlowBuckets(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	frames := make([][]byte, 0)
+	flows := make(map[string]string)
+	for i := 0; i < 16; i++ {
+		client, server := net.IP{10, 0, 1, byte(i)}, net.IP{10, 0, 2, byte(i)}
+		forward := udpFrame(t, client, server, uint16(40000+i), 53)
+		reverse := udpFrame(t, server, client, 53, uint16(40000+i))
+		flows[string(forward)] = string(forward)
+		flows[string(reverse)] = string(forward)
+		frames = append(frames, forward, reverse)
+	}
+	// directions of each flow are in different input files
+	var forward, reverse [][]byte
+	for i, f := range frames {
+		if i%2 == 0 {
+			forward = append(forward, f)
+		} else {
+			reverse = append(reverse, f)
+		}
+	}
+	paths := writeTestPcaps(t, t.TempDir(),
+		pcapOf(t, ts, time.Second, forward...),
+		pcapOf(t, ts.Add(time.Millisecond), time.Second, reverse...),
+	)
+	out := t.TempDir()
+	written, err := Split(SplitConfig{
+		Files:       paths,
+		Output:      rotate.Config{Dir: out, Template: "flow.%n.pcap"},
+		FlowBuckets: 4,
+		Ctx:         context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) < 2 {
+		t.Fatalf("16 flows written into %d buckets", len(written))
+	}
+	bucketOf := make(map[string]string)
+	var total int
+	for _, f := range written {
+		for _, data := range readTestPcap(t, f.Path) {
+			flow := flows[string(data)]
+			if prev, ok := bucketOf[flow]; ok && prev != f.Path {
+				t.Fatalf("flow split between %s and %s", prev, f.Path)
+			}
+			bucketOf[flow] = f.Path
+			total++
+		}
+	}
+	if total != len(frames) {
+		t.Fatalf("split %d packets, expected %d", total, len(frames))
+	}
+}
+
+func TestSplitRotation(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		desc   string
+		output rotate.Config
+		counts []int
+	}{
+		{
+			desc:   "packet count",
+			output: rotate.Config{MaxPackets: 4},
+			counts: []int{4, 4, 2},
+		},
+		{
+			desc:   "duration",
+			output: rotate.Config{MaxDuration: 3 * time.Second},
+			counts: []int{3, 3, 3, 1},
+		},
+		{
+			desc: "size",
+			// pcap file header and three records of two byte packets
+			output: rotate.Config{MaxBytes: 24 + 3*(16+2)},
+			counts: []int{3, 3, 3, 1},
+		},
+	}
+	for _, tc := range testCases {
+		// two inputs interleave into one packet per second
+		paths := writeTestPcaps(t, t.TempDir(),
+			testPcap(t, 5, ts, 2*time.Second),
+			testPcap(t, 5, ts.Add(time.Second), 2*time.Second),
+		)
+		tc.output.Dir = t.TempDir()
+		tc.output.Template = "out.%t.pcap"
+		written, err := Split(SplitConfig{Files: paths, Output: tc.output, Ctx: context.Background()})
+		if err != nil {
+			t.Fatalf("%s: %s", tc.desc, err)
+		}
+		if len(written) != len(tc.counts) {
+			t.Fatalf("%s: got %d files, expected %d", tc.desc, len(written), len(tc.counts))
+		}
+		var idx int
+		for i, f := range written {
+			if f.Packets != tc.counts[i] {
+				t.Fatalf("%s: file %d has %d packets, expected %d", tc.desc, i, f.Packets, tc.counts[i])
+			}
+			if expected := ts.Add(time.Duration(idx) * time.Second); !f.Beginning.Equal(expected) {
+				t.Fatalf("%s: file %d begins at %s, expected %s", tc.desc, i, f.Beginning, expected)
+			}
+			idx += f.Packets
+		}
+	}
+}
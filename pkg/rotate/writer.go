@@ -0,0 +1,279 @@
+/*
+Copyright © 2022 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package rotate
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/StamusNetworks/gophercap/pkg/models"
+	"github.com/StamusNetworks/gophercap/pkg/pcapng"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcap file header and per-packet record header sizes in bytes
+const (
+	fileHeaderSize   = 24
+	packetHeaderSize = 16
+)
+
+/*
+Config holds params for a rotating pcap writer.
+
+File names are built from Template which supports Suricata style expansion.
+- %n -- stream number, such as flow bucket
+- %i -- same as %n
+- %t -- unix timestamp of first packet in file
+*/
+type Config struct {
+	Dir      string
+	Template string
+	Stream   int
+
+	LinkType layers.LinkType
+	Snaplen  uint32
+	Compress bool
+	// Pcapng writes pcapng instead of pcap, which allows per-packet comments
+	Pcapng bool
+
+	// MaxBytes rotates file once it has grown over this size, 0 disables. Size is counted
+	// before compression, so compressed files on disk are smaller.
+	MaxBytes int64
+	// MaxDuration rotates file once packet timestamps span over this duration, 0 disables
+	MaxDuration time.Duration
+	// MaxPackets rotates file once it holds this many packets, 0 disables
+	MaxPackets int
+}
+
+// Rotates reports if any rotation limit is defined
+func (c Config) Rotates() bool {
+	return c.MaxBytes > 0 || c.MaxDuration > 0 || c.MaxPackets > 0
+}
+
+/*
+Validate implements a standard interface for checking config struct validity and setting
+sane default values.
+*/
+func (c *Config) Validate() error {
+	if c.Template == "" {
+		return errors.New("missing output file name template")
+	}
+	if c.Rotates() && !strings.Contains(c.Template, "%t") {
+		return errors.New("file rotation needs %t in output file name template")
+	}
+	if c.MaxBytes < 0 || c.MaxDuration < 0 || c.MaxPackets < 0 {
+		return errors.New("rotation limits must not be negative")
+	}
+	if c.Snaplen == 0 {
+		c.Snaplen = 1024 * 64
+	}
+	if c.LinkType == layers.LinkTypeNull {
+		c.LinkType = layers.LinkTypeEthernet
+	}
+	return nil
+}
+
+// File holds metadata for a single written pcap file
+type File struct {
+	Path    string `json:"path"`
+	Packets int    `json:"packets"`
+	Bytes   int64  `json:"bytes"`
+	// SHA256 is hex encoded digest of file as written to disk, including compression
+	SHA256 string `json:"sha256"`
+	models.Period
+}
+
+/*
+Writer writes packets into pcap files and rotates them when limits in Config are reached.
+Files are created lazily on first packet, so no empty files are left behind.
+*/
+type Writer struct {
+	Config
+
+	file   *os.File
+	buf    *bufio.Writer
+	gz     *gzip.Writer
+	writer *pcapgo.Writer
+	ng     *pcapng.Writer
+	digest hash.Hash
+
+	current *File
+	files   []File
+	names   map[string]bool
+}
+
+// NewWriter creates a new rotating writer
+func NewWriter(c Config) (*Writer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &Writer{Config: c, files: make([]File, 0), names: make(map[string]bool)}, nil
+}
+
+// WritePacket implements gopacket writer interface
+func (w *Writer) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return w.WritePacketComment(ci, data, "")
+}
+
+// WritePacketComment stores packet with a comment, comments are dropped unless writing pcapng
+func (w *Writer) WritePacketComment(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	if w.current != nil && w.full(ci) {
+		if err := w.closeFile(); err != nil {
+			return err
+		}
+	}
+	if w.current == nil {
+		if err := w.openFile(ci.Timestamp); err != nil {
+			return err
+		}
+	}
+	if w.Pcapng {
+		if err := w.ng.WritePacketComment(ci, data, comment); err != nil {
+			return err
+		}
+		w.current.Bytes += int64(pcapng.BlockSize(len(data), len(comment)))
+	} else {
+		if err := w.writer.WritePacket(ci, data); err != nil {
+			return err
+		}
+		w.current.Bytes += int64(packetHeaderSize + len(data))
+	}
+	w.current.Packets++
+	if w.current.Beginning.IsZero() || ci.Timestamp.Before(w.current.Beginning) {
+		w.current.Beginning = ci.Timestamp
+	}
+	if ci.Timestamp.After(w.current.End) {
+		w.current.End = ci.Timestamp
+	}
+	return nil
+}
+
+// Close flushes and closes currently open file
+func (w *Writer) Close() error {
+	if w.current == nil {
+		return nil
+	}
+	return w.closeFile()
+}
+
+// Files lists metadata for all closed files
+func (w Writer) Files() []File {
+	return w.files
+}
+
+func (w Writer) full(ci gopacket.CaptureInfo) bool {
+	switch {
+	case w.MaxBytes > 0 && w.current.Bytes+int64(packetHeaderSize+ci.CaptureLength) > w.MaxBytes:
+		return true
+	case w.MaxPackets > 0 && w.current.Packets >= w.MaxPackets:
+		return true
+	case w.MaxDuration > 0 && ci.Timestamp.Sub(w.current.Beginning) >= w.MaxDuration:
+		return true
+	}
+	return false
+}
+
+func (w *Writer) openFile(ts time.Time) error {
+	path := filepath.Join(w.Dir, w.name(ts))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.digest = sha256.New()
+	w.buf = bufio.NewWriterSize(io.MultiWriter(f, w.digest), 1024*64)
+	var out io.Writer = w.buf
+	if w.Compress {
+		w.gz = gzip.NewWriter(w.buf)
+		out = w.gz
+	}
+	if w.Pcapng {
+		if w.ng, err = pcapng.NewWriter(out, w.LinkType, w.Snaplen); err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		w.writer = pcapgo.NewWriter(out)
+		if err := w.writer.WriteFileHeader(w.Snaplen, w.LinkType); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	w.current = &File{Path: path, Bytes: fileHeaderSize}
+	return nil
+}
+
+func (w *Writer) closeFile() error {
+	defer func() {
+		w.files = append(w.files, *w.current)
+		w.current = nil
+		w.gz = nil
+	}()
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	w.current.SHA256 = hex.EncodeToString(w.digest.Sum(nil))
+	return w.file.Close()
+}
+
+func (w *Writer) name(ts time.Time) string {
+	base := Expand(w.Template, w.Stream, ts)
+	if w.Compress {
+		// suffix is added back after index, template may already have it
+		base = strings.TrimSuffix(base, ".gz")
+	}
+	ext := filepath.Ext(base)
+	name := base
+	// multiple files can begin within same second, index goes before extension
+	for i := 1; w.names[name]; i++ {
+		name = strings.TrimSuffix(base, ext) + "." + strconv.Itoa(i) + ext
+	}
+	w.names[name] = true
+	if w.Compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// Expand fills Suricata style file name template
+func Expand(template string, stream int, ts time.Time) string {
+	return strings.NewReplacer(
+		"%n", strconv.Itoa(stream),
+		"%i", strconv.Itoa(stream),
+		"%t", strconv.FormatInt(ts.Unix(), 10),
+	).Replace(template)
+}
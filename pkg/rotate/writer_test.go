@@ -0,0 +1,162 @@
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+func writePackets(t *testing.T, c Config, stamps []time.Time, size int) []File {
+	w, err := NewWriter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	for _, ts := range stamps {
+		if err := w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     ts,
+			CaptureLength: size,
+			Length:        size,
+		}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.Files()
+}
+
+func stampsEvery(start time.Time, step time.Duration, count int) []time.Time {
+	stamps := make([]time.Time, count)
+	for i := range stamps {
+		stamps[i] = start.Add(time.Duration(i) * step)
+	}
+	return stamps
+}
+
+func packetCounts(files []File) []int {
+	counts := make([]int, len(files))
+	for i, f := range files {
+		counts[i] = f.Packets
+	}
+	return counts
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWriterRotation(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		desc   string
+		config Config
+		stamps []time.Time
+		counts []int
+	}{
+		{
+			desc:   "no rotation",
+			config: Config{Template: "out.pcap"},
+			stamps: stampsEvery(start, time.Second, 5),
+			counts: []int{5},
+		},
+		{
+			desc:   "packet count",
+			config: Config{Template: "out.%t.pcap", MaxPackets: 3},
+			stamps: stampsEvery(start, time.Second, 7),
+			counts: []int{3, 3, 1},
+		},
+		{
+			desc:   "duration",
+			config: Config{Template: "out.%t.pcap", MaxDuration: 10 * time.Second},
+			stamps: []time.Time{
+				start,
+				start.Add(9 * time.Second),
+				// exactly at the limit begins a new file
+				start.Add(10 * time.Second),
+				start.Add(15 * time.Second),
+				start.Add(40 * time.Second),
+			},
+			counts: []int{2, 2, 1},
+		},
+		{
+			desc: "size",
+			// file header and two packets of 84 bytes with record headers
+			config: Config{Template: "out.%t.pcap", MaxBytes: fileHeaderSize + 2*(packetHeaderSize+84)},
+			stamps: stampsEvery(start, time.Second, 5),
+			counts: []int{2, 2, 1},
+		},
+	}
+	for _, tc := range testCases {
+		tc.config.Dir = t.TempDir()
+		files := writePackets(t, tc.config, tc.stamps, 84)
+		if counts := packetCounts(files); !equalInts(counts, tc.counts) {
+			t.Fatalf("%s: packets per file %v, expected %v", tc.desc, counts, tc.counts)
+		}
+		var idx int
+		for _, f := range files {
+			stat, err := os.Stat(f.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Size() != f.Bytes {
+				t.Fatalf("%s: %s has %d bytes, metadata has %d", tc.desc, f.Path, stat.Size(), f.Bytes)
+			}
+			if tc.config.MaxBytes > 0 && f.Bytes > tc.config.MaxBytes {
+				t.Fatalf("%s: %s has %d bytes, over limit", tc.desc, f.Path, f.Bytes)
+			}
+			if !f.Beginning.Equal(tc.stamps[idx]) || !f.End.Equal(tc.stamps[idx+f.Packets-1]) {
+				t.Fatalf("%s: %s period %s - %s", tc.desc, f.Path, f.Beginning, f.End)
+			}
+			idx += f.Packets
+		}
+	}
+}
+
+func TestWriterName(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	// all files begin within same second
+	stamps := stampsEvery(start, time.Millisecond, 3)
+	cases := []struct {
+		template string
+		compress bool
+	}{
+		{"out.%t.pcap", false},
+		{"out.%t.pcap", true},
+		{"out.%t.pcap.gz", true},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		files := writePackets(t, Config{
+			Dir:        dir,
+			Template:   c.template,
+			Compress:   c.compress,
+			MaxPackets: 1,
+		}, stamps, 64)
+		expected := []string{"out.1640995200.pcap", "out.1640995200.1.pcap", "out.1640995200.2.pcap"}
+		if len(files) != len(expected) {
+			t.Fatalf("%s compress %t: got %d files", c.template, c.compress, len(files))
+		}
+		for i, f := range files {
+			name := expected[i]
+			if c.compress {
+				name += ".gz"
+			}
+			if f.Path != filepath.Join(dir, name) {
+				t.Fatalf("%s compress %t: file %d is %s, expected %s", c.template, c.compress, i, f.Path, name)
+			}
+		}
+	}
+}